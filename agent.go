@@ -0,0 +1,103 @@
+// vm / agent.go
+//
+// MIT License Copyright(c) 2021 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+//
+package main
+
+import (
+    "fmt"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "strings"
+    "time"
+
+    "vm/proc"
+    "vm/qemu"
+    "vm/qga"
+)
+
+func dialAgent(vm *proc.VM, timeout time.Duration) (*qga.Agent, error) {
+    return qga.Dial(filepath.Join(vm.VM_dir, qemu.GuestAgentSocket), timeout)
+}
+
+func status(opts []string) {
+    if len(opts) == 0 {
+	fmt.Println("vm status <name>")
+	os.Exit(1)
+    }
+    vm := proc.GetVM(opts[0])
+    if vm == nil {
+	fmt.Printf("no vm %s\n", opts[0])
+	os.Exit(1)
+    }
+    fmt.Printf("name: %s\n", vm.Name)
+    fmt.Printf("pid: %d\n", vm.Pid)
+    fmt.Printf("dir: %s\n", vm.VM_dir)
+    fmt.Printf("local: %s\n", vm.VM_local_net)
+    showUsage(vm.Pid, vm.VM_name)
+    agent, err := dialAgent(vm, 2 * time.Second)
+    if err != nil {
+	fmt.Printf("agent: %v\n", err)
+	return
+    }
+    defer agent.Close()
+    ifs, err := agent.NetworkInterfaces()
+    if err != nil {
+	fmt.Printf("agent: %v\n", err)
+	return
+    }
+    for _, i := range ifs {
+	addrs := []string{}
+	for _, ip := range i.IPAddresses {
+	    addrs = append(addrs, fmt.Sprintf("%s/%d", ip.Address, ip.Prefix))
+	}
+	fmt.Printf("guest %s %s %s\n", i.Name, i.HardwareAddress, strings.Join(addrs, " "))
+    }
+}
+
+// gexec runs a command in the guest through the agent,
+// vm exec <name> [--timeout seconds] -- cmd
+func gexec(opts []string) {
+    cmdline := []string{}
+    for i, opt := range opts {
+	if opt == "--" {
+	    cmdline = opts[i + 1:]
+	    opts = opts[:i]
+	    break
+	}
+    }
+    flags, opts := cmdflags(opts, "timeout")
+    timeout, err := seconds(flags, "timeout", 60)
+    if err != nil || len(opts) == 0 || len(cmdline) == 0 {
+	fmt.Println("vm exec <name> [--timeout seconds] -- command [args...]")
+	os.Exit(1)
+    }
+    vm := proc.GetVM(opts[0])
+    if vm == nil {
+	fmt.Printf("no vm %s\n", opts[0])
+	os.Exit(1)
+    }
+    agent, err := dialAgent(vm, 10 * time.Second)
+    if err != nil {
+	fmt.Printf("agent: %v\n", err)
+	os.Exit(1)
+    }
+    defer agent.Close()
+    var input []byte
+    if info, err := os.Stdin.Stat(); err == nil && info.Mode() & os.ModeCharDevice == 0 {
+	input, _ = ioutil.ReadAll(os.Stdin)
+    }
+    res, err := agent.Exec(cmdline[0], cmdline[1:], input, time.Duration(timeout) * time.Second)
+    if err != nil {
+	fmt.Printf("exec: %v\n", err)
+	os.Exit(1)
+    }
+    os.Stdout.Write(res.Stdout)
+    os.Stderr.Write(res.Stderr)
+    if res.Signal != 0 {
+	os.Exit(128 + res.Signal)
+    }
+    os.Exit(res.ExitCode)
+}
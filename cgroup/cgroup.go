@@ -0,0 +1,206 @@
+// vm/cgroup
+//
+// MIT License Copyright(c) 2021 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+//
+package cgroup
+
+import (
+    "fmt"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "syscall"
+)
+
+// Root is where the cgroup v2 hierarchy is mounted
+var Root = "/sys/fs/cgroup"
+
+// Group is a cgroup v2 directory
+type Group struct {
+    Path string
+}
+
+// Of returns the cgroup of pid, use 0 for ourselves
+func Of(pid int) (*Group, error) {
+    file := "/proc/self/cgroup"
+    if pid != 0 {
+	file = fmt.Sprintf("/proc/%d/cgroup", pid)
+    }
+    data, err := ioutil.ReadFile(file)
+    if err != nil {
+	return nil, fmt.Errorf("cgroup: %v", err)
+    }
+    for _, line := range strings.Split(string(data), "\n") {
+	// unified hierarchy is 0::/path
+	if strings.HasPrefix(line, "0::") {
+	    return &Group{ Path: filepath.Join(Root, line[3:]) }, nil
+	}
+    }
+    return nil, fmt.Errorf("cgroup: no cgroup v2 for %s", file)
+}
+
+// Open returns the group at path relative to Root
+func Open(path string) *Group {
+    return &Group{ Path: filepath.Join(Root, path) }
+}
+
+// UserService returns user@<uid>.service, the group systemd delegates to the user
+func UserService(uid int) *Group {
+    return Open(fmt.Sprintf("user.slice/user-%d.slice/user@%d.service", uid, uid))
+}
+
+func (g *Group)Parent() *Group {
+    return &Group{ Path: filepath.Dir(g.Path) }
+}
+
+// Owned tells whether the group is delegated to uid, that is uid may
+// create groups in it and move its processes around
+func (g *Group)Owned(uid int) bool {
+    fi, err := os.Stat(filepath.Join(g.Path, "cgroup.procs"))
+    if err != nil {
+	return false
+    }
+    st, ok := fi.Sys().(*syscall.Stat_t)
+    return ok && int(st.Uid) == uid
+}
+
+func contains(list, word string) bool {
+    for _, w := range strings.Fields(list) {
+	if w == word {
+	    return true
+	}
+    }
+    return false
+}
+
+// Create makes the child group name with the controllers enabled for it.
+// They are enabled one by one as far as g has them, a delegation often
+// lacks io, and the enabled ones are returned.
+func (g *Group)Create(name string, controllers []string) (*Group, []string, error) {
+    enabled := []string{}
+    if len(controllers) > 0 {
+	avail, err := g.Get("cgroup.controllers")
+	if err != nil {
+	    return nil, nil, err
+	}
+	on, _ := g.Get("cgroup.subtree_control")
+	for _, c := range controllers {
+	    if contains(on, c) {
+		enabled = append(enabled, c)
+		continue
+	    }
+	    if !contains(avail, c) {
+		continue
+	    }
+	    if g.Set("cgroup.subtree_control", "+" + c) == nil {
+		enabled = append(enabled, c)
+	    }
+	}
+    }
+    child := &Group{ Path: filepath.Join(g.Path, name) }
+    if err := os.Mkdir(child.Path, 0755); err != nil && !os.IsExist(err) {
+	return nil, nil, fmt.Errorf("cgroup: %v", err)
+    }
+    return child, enabled, nil
+}
+
+func (g *Group)Set(file, value string) error {
+    path := filepath.Join(g.Path, file)
+    if err := ioutil.WriteFile(path, []byte(value), 0644); err != nil {
+	return fmt.Errorf("cgroup: %s %v", path, err)
+    }
+    return nil
+}
+
+func (g *Group)Get(file string) (string, error) {
+    data, err := ioutil.ReadFile(filepath.Join(g.Path, file))
+    if err != nil {
+	return "", fmt.Errorf("cgroup: %v", err)
+    }
+    return strings.TrimSpace(string(data)), nil
+}
+
+// Add moves pid with all its threads into the group
+func (g *Group)Add(pid int) error {
+    return g.Set("cgroup.procs", strconv.Itoa(pid))
+}
+
+// MoveAll moves every process of g into to, g must be empty before
+// controllers are enabled for its children
+func (g *Group)MoveAll(to *Group) error {
+    procs, err := g.Get("cgroup.procs")
+    if err != nil {
+	return err
+    }
+    for _, pid := range strings.Fields(procs) {
+	if err := to.Set("cgroup.procs", pid); err != nil {
+	    return err
+	}
+    }
+    return nil
+}
+
+// Remove deletes the group, it must be empty
+func (g *Group)Remove() error {
+    return os.Remove(g.Path)
+}
+
+// Usage is a summary of what the group consumed
+type Usage struct {
+    CPUUsec uint64
+    Memory uint64
+    MemoryPeak uint64
+    IORead, IOWrite uint64
+}
+
+// keyed parses "key value" lines as in cpu.stat
+func keyed(text string) map[string]uint64 {
+    m := map[string]uint64{}
+    for _, line := range strings.Split(text, "\n") {
+	f := strings.Fields(line)
+	if len(f) != 2 {
+	    continue
+	}
+	v, err := strconv.ParseUint(f[1], 10, 64)
+	if err != nil {
+	    continue
+	}
+	m[f[0]] = v
+    }
+    return m
+}
+
+func (g *Group)Usage() (*Usage, error) {
+    u := &Usage{}
+    stat, err := g.Get("cpu.stat")
+    if err != nil {
+	return nil, err
+    }
+    u.CPUUsec = keyed(stat)["usage_usec"]
+    if mem, err := g.Get("memory.current"); err == nil {
+	u.Memory, _ = strconv.ParseUint(mem, 10, 64)
+    }
+    if peak, err := g.Get("memory.peak"); err == nil {
+	u.MemoryPeak, _ = strconv.ParseUint(peak, 10, 64)
+    }
+    // io.stat is one line per device: 8:0 rbytes=N wbytes=N ...
+    if io, err := g.Get("io.stat"); err == nil {
+	for _, line := range strings.Split(io, "\n") {
+	    for _, kv := range strings.Fields(line) {
+		a := strings.SplitN(kv, "=", 2)
+		if len(a) != 2 {
+		    continue
+		}
+		v, _ := strconv.ParseUint(a[1], 10, 64)
+		switch a[0] {
+		case "rbytes": u.IORead += v
+		case "wbytes": u.IOWrite += v
+		}
+	    }
+	}
+    }
+    return u, nil
+}
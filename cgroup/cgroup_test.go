@@ -0,0 +1,62 @@
+// vm/cgroup / cgroup_test.go
+//
+// MIT License Copyright(c) 2021 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+//
+package cgroup
+
+import (
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "reflect"
+    "testing"
+)
+
+func TestCreate(t *testing.T) {
+    dir := t.TempDir()
+    // a user delegation without io, cpu is on already
+    ioutil.WriteFile(filepath.Join(dir, "cgroup.controllers"), []byte("cpu memory pids\n"), 0644)
+    ioutil.WriteFile(filepath.Join(dir, "cgroup.subtree_control"), []byte("cpu\n"), 0644)
+    ioutil.WriteFile(filepath.Join(dir, "cgroup.procs"), nil, 0644)
+    g := &Group{ Path: dir }
+    child, enabled, err := g.Create("vm-test", []string{ "cpu", "memory", "io" })
+    if err != nil {
+	t.Fatal(err)
+    }
+    if !reflect.DeepEqual(enabled, []string{ "cpu", "memory" }) {
+	t.Errorf("enabled %v", enabled)
+    }
+    // one controller a write, the kernel takes them so
+    if got, _ := g.Get("cgroup.subtree_control"); got != "+memory" {
+	t.Errorf("subtree_control %q", got)
+    }
+    if fi, err := os.Stat(child.Path); err != nil || !fi.IsDir() {
+	t.Errorf("no group %s", child.Path)
+    }
+    if !g.Owned(os.Getuid()) {
+	t.Errorf("not owned")
+    }
+}
+
+func TestMoveAll(t *testing.T) {
+    dir := t.TempDir()
+    ioutil.WriteFile(filepath.Join(dir, "cgroup.procs"), []byte("100\n101\n"), 0644)
+    g := &Group{ Path: dir }
+    leaf, _, err := g.Create("launcher", nil)
+    if err != nil {
+	t.Fatal(err)
+    }
+    ioutil.WriteFile(filepath.Join(leaf.Path, "cgroup.procs"), nil, 0644)
+    if err := g.MoveAll(leaf); err != nil {
+	t.Fatal(err)
+    }
+    // the kernel appends, the file keeps the last one
+    if got, _ := leaf.Get("cgroup.procs"); got != "101" {
+	t.Errorf("moved %q", got)
+    }
+    os.RemoveAll(leaf.Path)
+    if err := g.MoveAll(leaf); err == nil {
+	t.Errorf("moved to a removed group")
+    }
+}
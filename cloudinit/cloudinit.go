@@ -14,30 +14,20 @@ import (
     "strings"
 
     "github.com/kdomanski/iso9660"
-)
 
-func keyval(s string) (string, string) {
-    kv := strings.SplitN(s, "=", 2)
-    if len(kv) != 2 {
-	return strings.TrimSpace(kv[0]), ""
-    }
-    return strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
-}
+    "vm/hostip"
+    "vm/qemu"
+)
 
 type CloudConfig struct {
     name string
     id int
     user string
     key string
+    // opts are the options as launch reads them, user defaults included
     opts map[string]string
 }
 
-func (cc *CloudConfig)localIP(inst int) string {
-    id8h := cc.id / 256
-    id8l := cc.id % 256
-    return fmt.Sprintf("127.%d.%d.%d", id8h, id8l, inst)
-}
-
 func (cc *CloudConfig)parseOptions() {
     for key, val := range cc.opts {
 	switch key {
@@ -56,17 +46,24 @@ func (cc *CloudConfig)parseOptions() {
     }
 }
 
-func (cc *CloudConfig)addOption(opt string) {
-    key, val := keyval(opt)
-    if val == "" {
-	return
+// sshAddr is where nic0 forwards ssh to, the default forwards unless
+// the forwards option says otherwise
+func (cc *CloudConfig)sshAddr() (string, int, error) {
+    scheme, err := hostip.Parse(cc.opts["hostip"], cc.id)
+    if err != nil {
+	return "", 0, err
     }
-    fmt.Printf("%s = %s\n", key, val)
-    if key[0] == '+' {
-	cc.opts[key[1:]] += " " + val
-    } else {
-	cc.opts[key] = val
+    list := cc.opts["forwards"]
+    if list == "" {
+	list = qemu.DefaultForwardList
+    }
+    fwds, err := qemu.ParseForwards(list)
+    if err != nil {
+	return "", 0, err
     }
+    nic0 := map[string][]qemu.Forward{ "vnic0": qemu.PlaceForwards(fwds, scheme, 0) }
+    addr, port := qemu.SSHAddr(nic0, scheme)
+    return addr, port, nil
 }
 
 func (cc *CloudConfig)keygen() error {
@@ -135,30 +132,17 @@ func (cc *CloudConfig)gen_metadata() error {
 }
 
 func Generate(dir, path string, opts []string) error {
-    f, err := os.Open(path)
+    // the config is read as launch reads it, only what we need is parsed
+    options, err := qemu.Options(path, opts)
     if err != nil {
 	return fmt.Errorf("Generate: %v", err)
     }
-    defer f.Close()
-    cc := &CloudConfig{}
-    cc.opts = map[string]string{}
-    // load config
-    data, err := ioutil.ReadAll(f)
-    lines := strings.Split(string(data), "\n")
-    for _, line := range lines {
-	if line == "" {
-	    continue
-	}
-	if line[0] == '#' {
-	    continue
-	}
-	cc.addOption(line)
-    }
-    // override
-    for _, opt := range opts {
-	cc.addOption(opt)
-    }
+    cc := &CloudConfig{ opts: options }
     cc.parseOptions()
+    addr, port, err := cc.sshAddr()
+    if err != nil {
+	return fmt.Errorf("Generate: %v", err)
+    }
     // generate keys
     if err := cc.keygen(); err != nil {
 	return err
@@ -198,5 +182,10 @@ func Generate(dir, path string, opts []string) error {
     if err := writer.WriteTo(iso, "cidata"); err != nil {
 	return err
     }
+    login := addr
+    if cc.user != "" {
+	login = cc.user + "@" + login
+    }
+    fmt.Printf("ssh -p %d -i %s %s\n", port, cc.key, login)
     return nil
 }
@@ -0,0 +1,216 @@
+// vm / group.go
+//
+// MIT License Copyright(c) 2021 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+//
+package main
+
+import (
+    "fmt"
+    "io/ioutil"
+    "os"
+    "os/exec"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// a group file has one VM per line
+//   label = dir [after=label,...] [delay=seconds] [wait=pid|ssh] [timeout=seconds]
+type member struct {
+    label string
+    dir string
+    after []string
+    delay time.Duration
+    wait string
+    timeout time.Duration
+}
+
+func groupPath(name string) string {
+    if _, err := os.Stat(name); err == nil {
+	return name
+    }
+    if dir, ok := os.LookupEnv("XDG_CONFIG_HOME"); ok && dir != "" {
+	return filepath.Join(dir, "vm", "groups", name)
+    }
+    home, _ := os.UserHomeDir()
+    return filepath.Join(home, ".config", "vm", "groups", name)
+}
+
+func parseGroup(path string) ([]member, error) {
+    data, err := ioutil.ReadFile(path)
+    if err != nil {
+	return nil, fmt.Errorf("group: %v", err)
+    }
+    base := filepath.Dir(path)
+    members := []member{}
+    for _, line := range strings.Split(string(data), "\n") {
+	if line == "" || line[0] == '#' {
+	    continue
+	}
+	label, val := keyval(line)
+	params := strings.Fields(val)
+	if label == "" || len(params) == 0 {
+	    return nil, fmt.Errorf("group: bad line %q", line)
+	}
+	m := member{
+	    label: label,
+	    dir: params[0],
+	    wait: "pid",
+	    timeout: 120 * time.Second,
+	}
+	if !filepath.IsAbs(m.dir) {
+	    m.dir = filepath.Join(base, m.dir)
+	}
+	for _, param := range params[1:] {
+	    key, val := keyval(param)
+	    switch key {
+	    case "after":
+		m.after = append(m.after, strings.Split(val, ",")...)
+	    case "delay", "timeout":
+		sec, err := strconv.Atoi(val)
+		if err != nil {
+		    return nil, fmt.Errorf("group: %s bad %s %q", label, key, val)
+		}
+		if key == "delay" {
+		    m.delay = time.Duration(sec) * time.Second
+		} else {
+		    m.timeout = time.Duration(sec) * time.Second
+		}
+	    case "wait":
+		m.wait = val
+	    default:
+		return nil, fmt.Errorf("group: %s unknown %s", label, param)
+	    }
+	}
+	members = append(members, m)
+    }
+    return order(members)
+}
+
+// order sorts members so that everyone comes after its dependencies,
+// keeping the file order otherwise
+func order(members []member) ([]member, error) {
+    index := map[string]int{}
+    for i, m := range members {
+	if _, ok := index[m.label]; ok {
+	    return nil, fmt.Errorf("group: duplicate %s", m.label)
+	}
+	index[m.label] = i
+    }
+    for _, m := range members {
+	for _, dep := range m.after {
+	    if _, ok := index[dep]; !ok {
+		return nil, fmt.Errorf("group: %s after unknown %s", m.label, dep)
+	    }
+	}
+    }
+    sorted := []member{}
+    state := map[string]int{} // 1: visiting, 2: done
+    var visit func(m member) error
+    visit = func(m member) error {
+	switch state[m.label] {
+	case 1:
+	    return fmt.Errorf("group: dependency loop at %s", m.label)
+	case 2:
+	    return nil
+	}
+	state[m.label] = 1
+	for _, dep := range m.after {
+	    if err := visit(members[index[dep]]); err != nil {
+		return err
+	    }
+	}
+	state[m.label] = 2
+	sorted = append(sorted, m)
+	return nil
+    }
+    for _, m := range members {
+	if err := visit(m); err != nil {
+	    return nil, err
+	}
+    }
+    return sorted, nil
+}
+
+func (m *member)up(exe string) error {
+    if vm := getVMByDir(m.dir); vm != nil {
+	fmt.Printf("%s: already running %d\n", m.label, vm.Pid)
+	return nil
+    }
+    if m.delay > 0 {
+	fmt.Printf("%s: delay %v\n", m.label, m.delay)
+	time.Sleep(m.delay)
+    }
+    fmt.Printf("%s: launch in %s\n", m.label, m.dir)
+    cmd := exec.Command(exe, "launch")
+    cmd.Dir = m.dir
+    cmd.Stdout = os.Stdout
+    cmd.Stderr = os.Stderr
+    if err := cmd.Run(); err != nil {
+	return fmt.Errorf("%s: launch %v", m.label, err)
+    }
+    deadline := time.Now().Add(m.timeout)
+    vm, err := waitPid(m.dir, m.timeout)
+    if err != nil {
+	return fmt.Errorf("%s: %v", m.label, err)
+    }
+    switch m.wait {
+    case "pid":
+    case "ssh":
+	addr, port := sshAddr(vm)
+	if err := waitPort(fmt.Sprintf("%s:%d", addr, port), "SSH-", time.Until(deadline)); err != nil {
+	    return fmt.Errorf("%s: %v", m.label, err)
+	}
+    default:
+	return fmt.Errorf("%s: unknown wait %s", m.label, m.wait)
+    }
+    fmt.Printf("%s: ready\n", m.label)
+    return nil
+}
+
+func (m *member)down() error {
+    vm := getVMByDir(m.dir)
+    if vm == nil {
+	fmt.Printf("%s: not running\n", m.label)
+	return nil
+    }
+    return stopVM(vm, m.timeout)
+}
+
+func group(opts []string, up bool) {
+    if len(opts) == 0 {
+	fmt.Println("vm <up|down> <group>")
+	os.Exit(1)
+    }
+    members, err := parseGroup(groupPath(opts[0]))
+    if err != nil {
+	fmt.Printf("%v\n", err)
+	os.Exit(1)
+    }
+    if !up {
+	failed := false
+	for i := len(members) - 1; i >= 0; i-- {
+	    if err := members[i].down(); err != nil {
+		fmt.Printf("%v\n", err)
+		failed = true
+	    }
+	}
+	if failed {
+	    os.Exit(1)
+	}
+	return
+    }
+    exe, err := os.Executable()
+    if err != nil {
+	fmt.Printf("%v\n", err)
+	os.Exit(1)
+    }
+    for _, m := range members {
+	if err := m.up(exe); err != nil {
+	    fmt.Printf("%v\n", err)
+	    os.Exit(1)
+	}
+    }
+}
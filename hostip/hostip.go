@@ -0,0 +1,102 @@
+// vm/hostip
+//
+// MIT License Copyright(c) 2021 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+//
+package hostip
+
+import (
+    "fmt"
+    "net"
+    "strings"
+)
+
+// Stride is how far the ports of two VMs are apart in the offset mode,
+// the instances 0-9 of a VM fit in it. A port p works for the ids up to
+// (65535 - p) / Stride - 1, that is 0-5213 with the default forwards.
+const Stride = 10
+
+// VNCBase is the port of vnc display 0
+const VNCBase = 5900
+
+// Scheme decides where the host side of a VM listens.
+//
+//   hostip = loopback       127.<id / 256>.<id % 256>.<inst>, the default
+//   hostip = offset [addr]  addr or 127.0.0.1, ports moved by id * Stride + inst,
+//                           inst 0-9 only
+//   hostip = bind addr      addr, ports as they are
+type Scheme struct {
+    Mode string `json:"mode"`
+    Addr string `json:"addr,omitempty"`
+    ID int `json:"-"`
+}
+
+func Loopback(id int) *Scheme {
+    return &Scheme{ Mode: "loopback", ID: id }
+}
+
+func Parse(val string, id int) (*Scheme, error) {
+    f := strings.Fields(val)
+    if len(f) == 0 {
+	return Loopback(id), nil
+    }
+    s := &Scheme{ Mode: f[0], ID: id }
+    switch {
+    case s.Mode == "loopback" && len(f) == 1:
+    case s.Mode == "offset" && len(f) == 1:
+	s.Addr = "127.0.0.1"
+    case (s.Mode == "offset" || s.Mode == "bind") && len(f) == 2:
+	if net.ParseIP(f[1]) == nil {
+	    return nil, fmt.Errorf("hostip: bad address %s", f[1])
+	}
+	s.Addr = f[1]
+    default:
+	return nil, fmt.Errorf("hostip: unknown %q", val)
+    }
+    return s, nil
+}
+
+// String returns the scheme in the form Parse takes
+func (s *Scheme)String() string {
+    if s.Mode == "loopback" {
+	return s.Mode
+    }
+    return s.Mode + " " + s.Addr
+}
+
+// IP is the host address for the instance inst
+func (s *Scheme)IP(inst int) string {
+    if s.Mode == "loopback" {
+	return fmt.Sprintf("127.%d.%d.%d", s.ID / 256, s.ID % 256, inst)
+    }
+    return s.Addr
+}
+
+// Port is the host port for the instance inst
+func (s *Scheme)Port(inst, port int) int {
+    if s.Mode == "offset" {
+	return port + s.ID * Stride + inst
+    }
+    return port
+}
+
+// Display is the vnc display on the host
+func (s *Scheme)Display() string {
+    if s.Mode == "loopback" {
+	return s.IP(0) + ":0"
+    }
+    return fmt.Sprintf("%s:%d", s.Addr, s.ID)
+}
+
+// DisplayPort is the port the vnc display listens on
+func (s *Scheme)DisplayPort() int {
+    if s.Mode == "loopback" {
+	return VNCBase
+    }
+    return VNCBase + s.ID
+}
+
+// Expand replaces $ip in a hostfwd with the address of the instance inst
+func (s *Scheme)Expand(fwd string, inst int) string {
+    return strings.Replace(fwd, "$ip", s.IP(inst), -1)
+}
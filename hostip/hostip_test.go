@@ -0,0 +1,64 @@
+// vm/hostip / hostip_test.go
+//
+// MIT License Copyright(c) 2021 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+//
+package hostip
+
+import (
+    "testing"
+)
+
+func TestScheme(t *testing.T) {
+    tests := []struct {
+	val string
+	id int
+	ip, display, fwd string
+	port int
+    }{
+	{ "", 258, "127.1.2.3", "127.1.2.0:0", "tcp:127.1.2.3:8080-:8080", 10022 },
+	{ "loopback", 1, "127.0.1.3", "127.0.1.0:0", "tcp:127.0.1.3:8080-:8080", 10022 },
+	{ "offset", 2, "127.0.0.1", "127.0.0.1:2", "tcp:127.0.0.1:8080-:8080", 10045 },
+	{ "offset 10.0.0.1", 0, "10.0.0.1", "10.0.0.1:0", "tcp:10.0.0.1:8080-:8080", 10025 },
+	{ "bind 0.0.0.0", 5, "0.0.0.0", "0.0.0.0:5", "tcp:0.0.0.0:8080-:8080", 10022 },
+    }
+    for _, tt := range tests {
+	s, err := Parse(tt.val, tt.id)
+	if err != nil {
+	    t.Errorf("%q: %v", tt.val, err)
+	    continue
+	}
+	if ip := s.IP(3); ip != tt.ip {
+	    t.Errorf("%q: ip %s, want %s", tt.val, ip, tt.ip)
+	}
+	if d := s.Display(); d != tt.display {
+	    t.Errorf("%q: display %s, want %s", tt.val, d, tt.display)
+	}
+	if fwd := s.Expand("tcp:$ip:8080-:8080", 3); fwd != tt.fwd {
+	    t.Errorf("%q: expand %s, want %s", tt.val, fwd, tt.fwd)
+	}
+	if port := s.Port(3, 10022); port != tt.port {
+	    t.Errorf("%q: port %d, want %d", tt.val, port, tt.port)
+	}
+	// the env form parses back to the same
+	if again, err := Parse(s.String(), tt.id); err != nil || *again != *s {
+	    t.Errorf("%q: %s parsed %v %v", tt.val, s, again, err)
+	}
+    }
+    // the last instance of a VM stays below the first of the next
+    a, _ := Parse("offset", 0)
+    b, _ := Parse("offset", 1)
+    if a.Port(Stride - 1, 10022) >= b.Port(0, 10022) {
+	t.Errorf("offset ports overlap %d %d", a.Port(Stride - 1, 10022), b.Port(0, 10022))
+    }
+    // the default forwards work up to id 5213
+    c, _ := Parse("offset", 5213)
+    if p := c.Port(Stride - 1, 13389); p > 65535 {
+	t.Errorf("id 5213 port %d", p)
+    }
+    for _, val := range []string{ "bind", "offset 1.2.3", "nat", "loopback 127.0.0.1" } {
+	if _, err := Parse(val, 1); err == nil {
+	    t.Errorf("%q: no error", val)
+	}
+    }
+}
@@ -0,0 +1,151 @@
+// vm / limit.go
+//
+// MIT License Copyright(c) 2021 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+//
+package main
+
+import (
+    "fmt"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "time"
+
+    "vm/cgroup"
+    "vm/qemu"
+)
+
+func readpid(path string) (int, error) {
+    data, err := ioutil.ReadFile(path)
+    if err != nil {
+	return 0, err
+    }
+    return strconv.Atoi(strings.TrimSpace(string(data)))
+}
+
+// cgroupParent is where vm-<name> goes, the configured parent or under
+// home when that is ours, so that qemu stays in the unit launching it,
+// else our delegated user@<uid>.service since the slice of a login
+// session is not delegated
+func cgroupParent(vm *qemu.VMConfig, home *cgroup.Group) *cgroup.Group {
+    if vm.Resources.Parent != "" {
+	return cgroup.Open(vm.Resources.Parent)
+    }
+    if home.Owned(os.Getuid()) {
+	return home
+    }
+    return cgroup.UserService(os.Getuid())
+}
+
+// enterCgroup creates vm-<name> with the limits and moves us into it, so that
+// qemu starts there and every page it touches is charged to the group.
+// It returns the group and our own to go back to, nil when nothing is limited.
+func enterCgroup(vm *qemu.VMConfig) (*cgroup.Group, *cgroup.Group) {
+    limits := vm.Resources.Limits()
+    if limits == nil {
+	return nil, nil
+    }
+    home, err := cgroup.Of(0)
+    if err != nil {
+	fmt.Printf("%v\n", err)
+	return nil, nil
+    }
+    parent := cgroupParent(vm, home)
+    if parent.Path == home.Path && home.Path != cgroup.Root {
+	// a group with controllers for its children holds no processes,
+	// ours wait in a leaf beside the VM
+	leaf, _, err := home.Create("launcher", nil)
+	if err == nil {
+	    err = home.MoveAll(leaf)
+	}
+	if err != nil {
+	    fmt.Printf("%v\n", err)
+	    return nil, nil
+	}
+	home = leaf
+    }
+    g, enabled, err := parent.Create("vm-" + vm.Name, vm.Resources.Controllers())
+    if err != nil {
+	fmt.Printf("%v\n", err)
+	return nil, nil
+    }
+    on := map[string]bool{}
+    for _, c := range enabled {
+	on[c] = true
+    }
+    for file, val := range limits {
+	c := strings.SplitN(file, ".", 2)[0]
+	if !on[c] {
+	    fmt.Printf("cgroup: no %s controller in %s, %s is not applied\n", c, parent.Path, file)
+	    continue
+	}
+	if err := g.Set(file, val); err != nil {
+	    fmt.Printf("%v\n", err)
+	}
+    }
+    if err := g.Add(os.Getpid()); err != nil {
+	fmt.Printf("%v\n", err)
+	if !parent.Owned(os.Getuid()) {
+	    fmt.Println("cgroup: launch from a systemd user unit or systemd-run --user --scope")
+	}
+	g.Remove()
+	return nil, nil
+    }
+    fmt.Printf("cgroup %s\n", g.Path)
+    return g, home
+}
+
+// leaveCgroup goes back home once qemu has started, the group is for qemu only
+func leaveCgroup(home *cgroup.Group) {
+    if home == nil {
+	return
+    }
+    if err := home.Add(os.Getpid()); err != nil {
+	fmt.Printf("%v\n", err)
+    }
+}
+
+// removeCgroup drops the group after qemu, it takes a moment to become empty
+func removeCgroup(g *cgroup.Group) {
+    if g == nil {
+	return
+    }
+    for i := 0; i < 20; i++ {
+	if err := g.Remove(); err == nil || os.IsNotExist(err) {
+	    return
+	}
+	time.Sleep(100 * time.Millisecond)
+    }
+    fmt.Printf("cgroup: %s is left\n", g.Path)
+}
+
+// showUsage reports the vm-<name> group of the VM, without limits qemu
+// is in the group of whoever launched it and that is not the VM's usage
+func showUsage(pid int, name string) {
+    g, err := cgroup.Of(pid)
+    if err != nil {
+	fmt.Printf("%v\n", err)
+	return
+    }
+    if filepath.Base(g.Path) != "vm-" + name {
+	fmt.Println("cgroup: none")
+	return
+    }
+    u, err := g.Usage()
+    if err != nil {
+	fmt.Printf("%v\n", err)
+	return
+    }
+    fmt.Printf("cgroup: %s\n", g.Path)
+    fmt.Printf("cpu: %.1fs\n", float64(u.CPUUsec) / 1e6)
+    fmt.Printf("memory: %d MiB (peak %d MiB)\n", u.Memory >> 20, u.MemoryPeak >> 20)
+    fmt.Printf("io: read %d MiB write %d MiB\n", u.IORead >> 20, u.IOWrite >> 20)
+    for _, file := range []string{ "cpu.weight", "cpu.max", "memory.max", "memory.high", "io.weight" } {
+	if val, err := g.Get(file); err == nil {
+	    fmt.Printf("%s: %s\n", file, strings.Replace(val, "\n", " ", -1))
+	}
+    }
+}
@@ -6,9 +6,11 @@
 package main
 
 import (
+    "encoding/json"
     "io/ioutil"
     "os"
     "fmt"
+    "strconv"
     "strings"
     "syscall"
 
@@ -21,27 +23,135 @@ func cinit(opts []string) {
     cwd, _ := os.Getwd()
     err := cloudinit.Generate(cwd, "config", opts)
     if err != nil {
+	fmt.Printf("cloudinit: %v\n", err)
 	return
     }
     fmt.Println("Generated")
 }
 
+// cmdflags splits --name and --name=value flags from the other arguments,
+// flags listed in valued may also take their value from the next argument
+func cmdflags(args []string, valued ...string) (map[string]string, []string) {
+    flags := map[string]string{}
+    rest := []string{}
+    for i := 0; i < len(args); i++ {
+	arg := args[i]
+	if len(arg) > 2 && arg[:2] == "--" {
+	    key, val := keyval(arg[2:])
+	    if val == "" && !strings.Contains(arg, "=") && i + 1 < len(args) {
+		for _, v := range valued {
+		    if v == key {
+			i++
+			val = args[i]
+			break
+		    }
+		}
+	    }
+	    flags[key] = val
+	    continue
+	}
+	rest = append(rest, arg)
+    }
+    return flags, rest
+}
+
+func keyval(s string) (string, string) {
+    kv := strings.SplitN(s, "=", 2)
+    if len(kv) != 2 {
+	return strings.TrimSpace(kv[0]), ""
+    }
+    return strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+}
+
+func hasflag(flags map[string]string, name string) bool {
+    _, ok := flags[name]
+    return ok
+}
+
+// seconds reads --name as a number of seconds, def when it is not given
+func seconds(flags map[string]string, name string, def int) (int, error) {
+    val, ok := flags[name]
+    if !ok {
+	return def, nil
+    }
+    n, err := strconv.Atoi(val)
+    if err != nil || n < 0 {
+	return 0, fmt.Errorf("bad --%s %q", name, val)
+    }
+    return n, nil
+}
+
+func dryrun(vm *qemu.VMConfig) {
+    cmd := vm.Qemu()
+    line := []string{}
+    for _, env := range vm.Env() {
+	key, val := keyval(env)
+	line = append(line, key + "=" + qemu.ShellQuote([]string{val}))
+    }
+    line = append(line, qemu.ShellQuote(cmd.Args))
+    for _, h := range vm.Helpers() {
+	fmt.Println(qemu.ShellQuote(h.Command()) + " &")
+    }
+    fmt.Println(strings.Join(line, " "))
+}
+
+// startHelpers starts what qemu connects to, all or nothing
+func startHelpers(vm *qemu.VMConfig) bool {
+    for _, h := range vm.Helpers() {
+	fmt.Printf("start %v\n", h.Command())
+	if _, err := h.Start(vm.Dir); err != nil {
+	    fmt.Printf("%v\n", err)
+	    qemu.StopHelpers(vm.Dir)
+	    return false
+	}
+    }
+    return true
+}
+
 func launch(opts []string) {
+    flags, opts := cmdflags(opts)
     cwd, _ := os.Getwd()
     vm, err := qemu.FromConfig(cwd, "config", opts)
     if err != nil {
+	fmt.Fprintf(os.Stderr, "%v\n", err)
+	os.Exit(1)
+    }
+    vm.Foreground = hasflag(flags, "foreground")
+    // stdout is only the JSON or the command line, the rest is on stderr
+    if hasflag(flags, "print-json") {
+	data, err := json.MarshalIndent(vm, "", "  ")
+	if err != nil {
+	    fmt.Fprintf(os.Stderr, "json: %v\n", err)
+	    os.Exit(1)
+	}
+	fmt.Println(string(data))
+	return
+    }
+    if hasflag(flags, "dry-run") {
+	dryrun(vm)
 	return
     }
+    if err := vm.Check(); err != nil {
+	fmt.Printf("%v\n", err)
+	os.Exit(1)
+    }
     prepare := vm.Prepare()
     if prepare != nil {
+	if vm.Foreground {
+	    // nstap runs us again, it becomes the supervised process
+	    os.Exit(supervise(prepare, nil))
+	}
 	out, err := prepare.Output()
+	fmt.Println(string(out))
 	if err != nil {
 	    fmt.Printf("Prepare %v\n", err)
+	    os.Exit(1)
 	}
-	fmt.Println(string(out))
 	return
     }
     cmd := vm.Qemu()
+    fmt.Println(cmd.Args[1:])
+    fmt.Println(vm.Env())
 
     // increase ulimit -n
     var r syscall.Rlimit
@@ -53,12 +163,42 @@ func launch(opts []string) {
 	}
     }
 
+    qemu.CleanHelpers(vm.Dir)
+    if !startHelpers(vm) {
+	os.Exit(1)
+    }
+    // qemu inherits the cgroup, the helpers are out of it
+    g, home := enterCgroup(vm)
+    if vm.Foreground {
+	code := supervise(cmd, func(pid int) {
+	    leaveCgroup(home)
+	    pin(vm, pid)
+	    post(vm)
+	})
+	unplugSwitches(vm.SwitchPorts())
+	qemu.StopHelpers(vm.Dir)
+	removeCgroup(g)
+	os.Exit(code)
+    }
+
     out, err := cmd.CombinedOutput()
+    leaveCgroup(home)
     fmt.Printf("%s\n", string(out))
     // daemonize and return
     if err != nil {
 	fmt.Printf("Run %v\n", err)
+	qemu.StopHelpers(vm.Dir)
+	removeCgroup(g)
+	os.Exit(1)
+    }
+    if pid, err := readpid(qemu.PidFile); err == nil {
+	pin(vm, pid)
+	watchQemu(vm, pid, g)
     }
+    post(vm)
+}
+
+func post(vm *qemu.VMConfig) {
     // Post commands
     posts := vm.Post()
     for _, cmd := range posts {
@@ -67,6 +207,7 @@ func launch(opts []string) {
 	    fmt.Printf("Run %v\n", err)
 	}
     }
+    plugSwitches(vm)
 }
 
 func list(opts []string) {
@@ -90,40 +231,41 @@ func list(opts []string) {
 
 func ssh(opts []string) {
     tgt := opts[0]
-    for _, vm := range proc.GetVMs() {
-	if (vm.Name == tgt) {
-	    fmt.Printf("ssh to %s\n", tgt)
-	    os.Chdir(vm.VM_dir)
-	    u := ""
-	    if data, err := ioutil.ReadFile("config"); err == nil {
-		for _, line := range strings.Split(string(data), "\n") {
-		    if line == "" || line[0] == '#' {
-			continue
-		    }
-		    f := strings.Fields(line)
-		    if f[0] == "user" {
-			u = f[2]
-			break
-		    }
-		}
-	    }
-	    // check priv keyfile
-	    key := "id_ed25519"
-	    if _, err := os.Stat(key); err != nil {
-		key = "id_ecdsa"
-		if _, err := os.Stat(key); err != nil {
-		    key = "id_rsa"
-		}
+    vm := proc.GetVM(tgt)
+    if vm == nil {
+	return
+    }
+    fmt.Printf("ssh to %s\n", tgt)
+    os.Chdir(vm.VM_dir)
+    u := ""
+    if data, err := ioutil.ReadFile("config"); err == nil {
+	for _, line := range strings.Split(string(data), "\n") {
+	    if line == "" || line[0] == '#' {
+		continue
 	    }
-	    args := []string{"ssh", "-p", "10022", "-i", key}
-	    if u != "" {
-		args = append(args, "-l", u)
+	    f := strings.Fields(line)
+	    if f[0] == "user" {
+		u = f[2]
+		break
 	    }
-	    args = append(args, vm.VM_local_net)
-	    err := syscall.Exec("/usr/bin/ssh", args, os.Environ())
-	    fmt.Printf("Exec: %v\n", err)
 	}
     }
+    // check priv keyfile
+    key := "id_ed25519"
+    if _, err := os.Stat(key); err != nil {
+	key = "id_ecdsa"
+	if _, err := os.Stat(key); err != nil {
+	    key = "id_rsa"
+	}
+    }
+    addr, port := sshAddr(vm)
+    args := []string{"ssh", "-p", strconv.Itoa(port), "-i", key}
+    if u != "" {
+	args = append(args, "-l", u)
+    }
+    args = append(args, addr)
+    err := syscall.Exec("/usr/bin/ssh", args, os.Environ())
+    fmt.Printf("Exec: %v\n", err)
 }
 
 func main() {
@@ -131,7 +273,7 @@ func main() {
 	os.Exit(1)
     }
     subcmd := os.Args[1]
-    fmt.Println(subcmd)
+    fmt.Fprintln(os.Stderr, subcmd)
     switch subcmd {
     case "cloudinit":
 	cinit(os.Args[2:])
@@ -141,7 +283,35 @@ func main() {
 	list(os.Args[2:])
     case "ssh":
 	ssh(os.Args[2:])
+    case "stop":
+	stop(os.Args[2:])
+    case "systemd":
+	systemd(os.Args[2:])
+    case "enable":
+	autostart(os.Args[2:], true)
+    case "disable":
+	autostart(os.Args[2:], false)
+    case "up":
+	group(os.Args[2:], true)
+    case "down":
+	group(os.Args[2:], false)
+    case "wait":
+	wait(os.Args[2:])
+    case "status":
+	status(os.Args[2:])
+    case "exec":
+	gexec(os.Args[2:])
+    case "ports":
+	ports(os.Args[2:])
+    case "forward":
+	forward(os.Args[2:])
+    case "reap":
+	reap(os.Args[2:])
     case "help":
-	fmt.Println("vm <cloudinit|launch|list|ssh>");
+	fmt.Println("vm <cloudinit|launch|list|ssh|stop|systemd|enable|disable|up|down|wait|status|exec|ports|forward>");
+	fmt.Println("vm launch [--dry-run|--print-json|--foreground] [key=value...]")
+	fmt.Println("vm wait <name> [--ssh|--port N|--agent] [--timeout seconds]")
+	fmt.Println("vm exec <name> [--timeout seconds] -- command [args...]")
+	fmt.Println("vm forward add|remove|list <name> [tcp:$ip:8080-:8080] [--netdev vnic0]")
     }
 }
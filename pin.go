@@ -0,0 +1,69 @@
+// vm / pin.go
+//
+// MIT License Copyright(c) 2021 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+//
+package main
+
+import (
+    "fmt"
+    "time"
+
+    "vm/proc"
+    "vm/qemu"
+    "vm/qmp"
+)
+
+// dialMonitor connects to the QMP socket, qemu may be starting up
+func dialMonitor(path string, timeout time.Duration) (*qmp.Monitor, error) {
+    deadline := time.Now().Add(timeout)
+    for {
+	m, err := qmp.Dial(path, time.Second)
+	if err == nil {
+	    return m, nil
+	}
+	if time.Now().After(deadline) {
+	    return nil, err
+	}
+	time.Sleep(100 * time.Millisecond)
+    }
+}
+
+// vcpus asks qemu for its vCPU threads and falls back to /proc
+func vcpus(pid int) map[int]int {
+    threads := map[int]int{}
+    if m, err := dialMonitor(qemu.QMPSocket, 10 * time.Second); err == nil {
+	defer m.Close()
+	cpus := []struct {
+	    Index int `json:"cpu-index"`
+	    Thread int `json:"thread-id"`
+	}{}
+	if err := m.Execute("query-cpus-fast", nil, &cpus); err == nil {
+	    for _, cpu := range cpus {
+		threads[cpu.Index] = cpu.Thread
+	    }
+	    return threads
+	}
+    }
+    return proc.VCPUThreads(pid)
+}
+
+// pin sets the affinity of the vCPU threads given by cpupin
+func pin(vm *qemu.VMConfig, pid int) {
+    if len(vm.CPUPin) == 0 {
+	return
+    }
+    threads := vcpus(pid)
+    for _, p := range vm.CPUPin {
+	tid, ok := threads[p.VCPU]
+	if !ok {
+	    fmt.Printf("cpupin: no thread for vcpu %d\n", p.VCPU)
+	    continue
+	}
+	if err := proc.SetAffinity(tid, p.Host); err != nil {
+	    fmt.Printf("cpupin: %v\n", err)
+	    continue
+	}
+	fmt.Printf("cpupin: vcpu %d thread %d -> %v\n", p.VCPU, tid, p.Host)
+    }
+}
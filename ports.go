@@ -0,0 +1,162 @@
+// vm / ports.go
+//
+// MIT License Copyright(c) 2021 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+//
+package main
+
+import (
+    "fmt"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "time"
+
+    "vm/hostip"
+    "vm/proc"
+    "vm/qemu"
+)
+
+// hostScheme is the host ip scheme the VM was launched with
+func hostScheme(vm *proc.VM) *hostip.Scheme {
+    id, _ := strconv.Atoi(vm.VM_id)
+    s, err := hostip.Parse(vm.VM_hostip, id)
+    if err != nil {
+	return hostip.Loopback(id)
+    }
+    return s
+}
+
+// vmForwards collects the forwards of slirp from the qemu command line
+// and of passt from the helpers
+func vmForwards(vm *proc.VM) map[string][]qemu.Forward {
+    fwds := qemu.HostForwards(proc.Procread(vm.Pid, "cmdline"))
+    for name, pid := range qemu.HelperPids(vm.VM_dir) {
+	if !strings.HasPrefix(name, "passt") {
+	    continue
+	}
+	list := qemu.PasstForwards(proc.Procread(pid, "cmdline"))
+	if len(list) > 0 {
+	    fwds[strings.Replace(name, "passt", "vnic", 1)] = list
+	}
+    }
+    return fwds
+}
+
+// sshAddr finds the host side of the forward to guest port 22,
+// cloudinit shows the same from the config
+func sshAddr(vm *proc.VM) (string, int) {
+    return qemu.SSHAddr(vmForwards(vm), hostScheme(vm))
+}
+
+// showForwards prints the forwards of each netdev
+func showForwards(fwds map[string][]qemu.Forward) {
+    for _, netdev := range qemu.Netdevs(fwds) {
+	for _, f := range fwds[netdev] {
+	    fmt.Printf("%s %s %s:%d -> %s:%d\n", netdev, f.Proto, f.HostAddr, f.HostPort, f.GuestAddr, f.GuestPort)
+	}
+    }
+}
+
+// ports lists the host to guest ports of a running VM from its qemu command line
+func ports(opts []string) {
+    if len(opts) == 0 {
+	fmt.Println("vm ports <name>")
+	os.Exit(1)
+    }
+    vm := proc.GetVM(opts[0])
+    if vm == nil {
+	fmt.Printf("no vm %s\n", opts[0])
+	os.Exit(1)
+    }
+    showForwards(vmForwards(vm))
+}
+
+// forwardRule expands $ip for the netdev and checks the rule,
+// remove accepts the host side only
+func forwardRule(vm *proc.VM, netdev, rule string, remove bool) (string, error) {
+    inst, err := strconv.Atoi(strings.TrimPrefix(netdev, "vnic"))
+    if err != nil {
+	return "", fmt.Errorf("bad netdev %s", netdev)
+    }
+    rule = hostScheme(vm).Expand(rule, inst)
+    if remove && !strings.Contains(rule, "-") {
+	// make it parsable with a dummy guest port
+	f, err := qemu.ParseForward(rule + "-1")
+	if err != nil {
+	    return "", err
+	}
+	return f.Host(), nil
+    }
+    f, err := qemu.ParseForward(rule)
+    if err != nil {
+	return "", err
+    }
+    if remove {
+	return f.Host(), nil
+    }
+    return f.String(), nil
+}
+
+// forward changes the slirp forwards of a running VM through the monitor
+// vm forward add|remove|list <name> [rule] [--netdev vnicN]
+func forward(opts []string) {
+    flags, args := cmdflags(opts, "netdev")
+    if len(args) < 2 {
+	fmt.Println("vm forward add|remove|list <name> [tcp:$ip:8080-:8080] [--netdev vnic0]")
+	os.Exit(1)
+    }
+    op := args[0]
+    vm := proc.GetVM(args[1])
+    if vm == nil {
+	fmt.Printf("no vm %s\n", args[1])
+	os.Exit(1)
+    }
+    netdev := "vnic0"
+    if hasflag(flags, "netdev") {
+	netdev = flags["netdev"]
+    }
+    line := ""
+    switch op {
+    case "list":
+	line = "info usernet"
+    case "add", "remove":
+	if len(args) < 3 {
+	    fmt.Printf("vm forward %s <name> <rule>\n", op)
+	    os.Exit(1)
+	}
+	rule, err := forwardRule(vm, netdev, args[2], op == "remove")
+	if err != nil {
+	    fmt.Printf("forward: %v\n", err)
+	    os.Exit(1)
+	}
+	line = fmt.Sprintf("hostfwd_%s %s %s", op, netdev, rule)
+    default:
+	fmt.Printf("unknown forward %s\n", op)
+	os.Exit(1)
+    }
+    m, err := dialMonitor(filepath.Join(vm.VM_dir, qemu.QMPSocket), 2 * time.Second)
+    if err != nil {
+	fmt.Printf("monitor: %v\n", err)
+	os.Exit(1)
+    }
+    defer m.Close()
+    out, err := m.HumanMonitorCommand(line)
+    if err != nil {
+	fmt.Printf("monitor: %v\n", err)
+	os.Exit(1)
+    }
+    fmt.Printf("%s\n", line)
+    // hostfwd_add is silent, hostfwd_remove tells it has removed the rule
+    failed := false
+    switch op {
+    case "add": failed = out != ""
+    case "remove": failed = !strings.Contains(out, "removed") || strings.Contains(out, "could not")
+    }
+    fmt.Print(out)
+    if failed {
+	m.Close()
+	os.Exit(1)
+    }
+}
@@ -11,6 +11,7 @@ import (
     "io/ioutil"
     "os"
     "strings"
+    "syscall"
 
     "github.com/mitchellh/go-ps"
 )
@@ -49,6 +50,10 @@ type VM struct {
     Name string
     Disp string
     VM_id, VM_name, VM_dir, VM_local_net string
+    // VM_hostip is empty for the loopback scheme
+    VM_hostip string
+    // VM_switches is switch/port of the socket netdevs
+    VM_switches string
 }
 
 func GetVMs() []VM {
@@ -77,6 +82,8 @@ func GetVMs() []VM {
 	    case "VM_NAME": vm.VM_name = kv[1]
 	    case "VM_DIR": vm.VM_dir = kv[1]
 	    case "VM_LOCAL_NET": vm.VM_local_net = kv[1]
+	    case "VM_HOSTIP": vm.VM_hostip = kv[1]
+	    case "VM_SWITCHES": vm.VM_switches = kv[1]
 	    }
 	}
 	vms = append(vms, vm)
@@ -84,6 +91,20 @@ func GetVMs() []VM {
     return vms
 }
 
+func GetVM(name string) *VM {
+    for _, vm := range GetVMs() {
+	if vm.Name == name {
+	    return &vm
+	}
+    }
+    return nil
+}
+
+// Alive tells whether the process still exists
+func Alive(pid int) bool {
+    return syscall.Kill(pid, 0) == nil
+}
+
 type NSNW struct {
     Pid int
     Name string
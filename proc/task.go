@@ -0,0 +1,65 @@
+// vm/proc / task.go
+//
+// MIT License Copyright(c) 2021 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+//
+package proc
+
+import (
+    "fmt"
+    "io/ioutil"
+    "strconv"
+    "strings"
+    "syscall"
+    "unsafe"
+)
+
+// VCPUThreads maps vCPU index to thread id from the names qemu gives
+// its vCPU threads, "CPU 0/KVM" or "CPU 0/TCG"
+func VCPUThreads(pid int) map[int]int {
+    threads := map[int]int{}
+    dir := fmt.Sprintf("/proc/%d/task", pid)
+    tasks, err := ioutil.ReadDir(dir)
+    if err != nil {
+	return threads
+    }
+    for _, task := range tasks {
+	tid, err := strconv.Atoi(task.Name())
+	if err != nil {
+	    continue
+	}
+	comm, err := ioutil.ReadFile(fmt.Sprintf("%s/%d/comm", dir, tid))
+	if err != nil {
+	    continue
+	}
+	name := strings.TrimSpace(string(comm))
+	if !strings.HasPrefix(name, "CPU ") {
+	    continue
+	}
+	a := strings.SplitN(name[4:], "/", 2)
+	if len(a) != 2 {
+	    continue
+	}
+	if n, err := strconv.Atoi(a[0]); err == nil {
+	    threads[n] = tid
+	}
+    }
+    return threads
+}
+
+// SetAffinity restricts the thread tid to cpus
+func SetAffinity(tid int, cpus []int) error {
+    var mask [16]uint64 // 1024 cpus like cpu_set_t
+    for _, c := range cpus {
+	if c < 0 || c >= len(mask) * 64 {
+	    return fmt.Errorf("affinity: cpu %d out of range", c)
+	}
+	mask[c / 64] |= 1 << uint(c % 64)
+    }
+    _, _, errno := syscall.RawSyscall(syscall.SYS_SCHED_SETAFFINITY,
+	    uintptr(tid), uintptr(len(mask) * 8), uintptr(unsafe.Pointer(&mask[0])))
+    if errno != 0 {
+	return fmt.Errorf("affinity: %d %v", tid, errno)
+    }
+    return nil
+}
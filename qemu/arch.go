@@ -0,0 +1,130 @@
+// vm/qemu / arch.go
+//
+// MIT License Copyright(c) 2021 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+//
+package qemu
+
+import (
+    "fmt"
+    "os"
+    "runtime"
+    "strings"
+)
+
+type archDefaults struct {
+    qemuexec string
+    machine string
+    machines []string // accepted machine types, also versioned like pc-q35-8.2
+    // cpu model when running on kvm and on tcg
+    kvmcpu, tcgcpu string
+    vga string
+}
+
+var archs = map[string]archDefaults{
+    "x86_64": {
+	qemuexec: "qemu-system-x86_64",
+	machines: []string{ "pc", "q35", "microvm" },
+	vga: "std",
+    },
+    "aarch64": {
+	qemuexec: "qemu-system-aarch64",
+	machine: "virt",
+	machines: []string{ "virt" },
+	kvmcpu: "host",
+	tcgcpu: "max",
+	vga: "virtio",
+    },
+    "riscv64": {
+	qemuexec: "qemu-system-riscv64",
+	machine: "virt",
+	machines: []string{ "virt", "spike" },
+	vga: "virtio",
+    },
+    "ppc64le": {
+	qemuexec: "qemu-system-ppc64",
+	machine: "pseries",
+	machines: []string{ "pseries", "powernv" },
+	vga: "std",
+    },
+}
+
+// hostArch returns the qemu name of the architecture we are running on
+func hostArch() string {
+    switch runtime.GOARCH {
+    case "amd64": return "x86_64"
+    case "arm64": return "aarch64"
+    case "386": return "i386"
+    case "loong64": return "loongarch64"
+    case "mips64le": return "mips64el"
+    case "mipsle": return "mipsel"
+    }
+    return runtime.GOARCH
+}
+
+// setupArch fills the defaults of the architecture and picks the accelerator.
+// A host not in archs still runs its own qemu-system-* with the qemu defaults.
+func (vm *VMConfig)setupArch() error {
+    arch, ok := archs[vm.Arch]
+    if !ok && vm.Arch == vm.host.Arch {
+	arch, ok = archDefaults{ qemuexec: "qemu-system-" + vm.Arch }, true
+    }
+    if !ok {
+	return fmt.Errorf("arch: unknown %s", vm.Arch)
+    }
+    if _, ok := vm.opts["qemu"]; !ok {
+	vm.QemuExec = arch.qemuexec
+    }
+    if _, ok := vm.opts["vga"]; !ok {
+	vm.VGA = arch.vga
+    }
+    if vm.Machine == "" {
+	vm.Machine = arch.machine
+    }
+    if vm.Machine != "" && len(arch.machines) > 0 {
+	known := false
+	// machine options may follow the type
+	typ := strings.SplitN(vm.Machine, ",", 2)[0]
+	for _, m := range arch.machines {
+	    if typ == m || strings.HasPrefix(typ, m + "-") {
+		known = true
+	    }
+	}
+	if !known {
+	    return fmt.Errorf("arch: machine %s is not for %s", vm.Machine, vm.Arch)
+	}
+    }
+    kvm := vm.Arch == vm.host.Arch && vm.host.KVM()
+    switch vm.Accel {
+    case "":
+	vm.Accel = "tcg"
+	if kvm {
+	    vm.Accel = "kvm"
+	}
+    case "kvm":
+	if !kvm {
+	    fmt.Fprintf(os.Stderr, "kvm is not available for %s, fallback to tcg\n", vm.Arch)
+	    vm.Accel = "tcg"
+	}
+    case "tcg":
+    default:
+	return fmt.Errorf("arch: unknown accel %s", vm.Accel)
+    }
+    if vm.CPU == "" {
+	if vm.Accel == "kvm" {
+	    vm.CPU = arch.kvmcpu
+	} else {
+	    vm.CPU = arch.tcgcpu
+	}
+    }
+    return nil
+}
+
+func (vm *VMConfig)machine() string {
+    v := []string{}
+    if vm.Machine != "" {
+	v = append(v, vm.Machine)
+    }
+    v = push(v, "accel", vm.Accel)
+    return strings.Join(v, ",")
+}
@@ -0,0 +1,257 @@
+// vm/qemu / builder.go
+//
+// MIT License Copyright(c) 2021 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+//
+package qemu
+
+import (
+    "fmt"
+    "strconv"
+    "strings"
+
+    "vm/hostip"
+)
+
+// NewNIC returns a virtio nic for instance inst and its user network,
+// the MAC address is derived from the VM id like the config does
+func (vm *VMConfig)NewNIC(inst int) (NIC, Network) {
+    netdev := fmt.Sprintf("vnic%d", inst)
+    nic := NIC{
+	Driver: "virtio-net",
+	Netdev: netdev,
+	MAC: fmt.Sprintf("52:54:00:%02x:%02x:%02x", vm.ID / 256, vm.ID % 256, inst),
+    }
+    net := Network{ Type: "user", Netdev: netdev }
+    return nic, net
+}
+
+// DefaultForwards returns the forwards of nicN=default,
+// ssh, http and rdp unless the forwards option says otherwise
+func (vm *VMConfig)DefaultForwards(inst int) []string {
+    fwds := []string{}
+    for _, f := range PlaceForwards(vm.Forwards, vm.hostIP(), inst) {
+	fwds = append(fwds, f.String())
+    }
+    return fwds
+}
+
+// SetHost gives the host lookups to a VM not made by NewVM,
+// like one unmarshalled from JSON
+func (vm *VMConfig)SetHost(host *Host) *VMConfig {
+    vm.host = host
+    return vm
+}
+
+func (vm *VMConfig)AddDrive(d Drive) *VMConfig {
+    vm.Drives = append(vm.Drives, d)
+    return vm
+}
+
+func (vm *VMConfig)AddNetwork(nic NIC, net Network) *VMConfig {
+    vm.NICs = append(vm.NICs, nic)
+    vm.Networks = append(vm.Networks, net)
+    return vm
+}
+
+// AddUSBHost adds a xhci controller unless it already exists
+func (vm *VMConfig)AddUSBHost(id string) *VMConfig {
+    for _, usbhost := range vm.USBHosts {
+	if usbhost.ID == id {
+	    return vm
+	}
+    }
+    vm.USBHosts = append(vm.USBHosts, USBHost{ ID: id })
+    return vm
+}
+
+func (vm *VMConfig)AddUSBDevice(dev USBDevice) *VMConfig {
+    if dev.Bus != "" {
+	vm.AddUSBHost(dev.Bus)
+    }
+    vm.USBDevices = append(vm.USBDevices, dev)
+    return vm
+}
+
+// AddUSBStorage adds the drive and the usb-storage device using it
+func (vm *VMConfig)AddUSBStorage(d Drive, bus string) *VMConfig {
+    d.Interface = "none"
+    vm.AddDrive(d)
+    return vm.AddUSBDevice(USBDevice{ Bus: bus, Device: "storage", Drive: d.ID })
+}
+
+func (vm *VMConfig)AddVirtfs(v Virtfs) *VMConfig {
+    vm.Virtfs = append(vm.Virtfs, v)
+    return vm
+}
+
+// AddVirtiofs adds the share, guest RAM has to be shared with virtiofsd
+func (vm *VMConfig)AddVirtiofs(fs Virtiofs) *VMConfig {
+    vm.Virtiofs = append(vm.Virtiofs, fs)
+    vm.Memory.Share = true
+    return vm
+}
+
+// Validate checks the configuration is consistent before rendering it
+func (vm *VMConfig)Validate() error {
+    if vm.Name == "" {
+	return fmt.Errorf("validate: no name")
+    }
+    // both come with NewVM
+    if vm.host == nil {
+	return fmt.Errorf("validate: no host")
+    }
+    if vm.HostIP == nil {
+	return fmt.Errorf("validate: no hostip")
+    }
+    if vm.ID < 0 || vm.ID > 65535 {
+	return fmt.Errorf("validate: id %d out of range", vm.ID)
+    }
+    if vm.QemuExec == "" {
+	return fmt.Errorf("validate: no qemu")
+    }
+    // the host runs its own qemu whatever it is
+    if _, ok := archs[vm.Arch]; !ok && vm.Arch != vm.host.Arch {
+	return fmt.Errorf("validate: unknown arch %s", vm.Arch)
+    }
+    switch vm.Accel {
+    case "", "kvm", "tcg":
+    default:
+	return fmt.Errorf("validate: unknown accel %s", vm.Accel)
+    }
+    drives := map[string]bool{}
+    for _, d := range vm.Drives {
+	if d.Path == "" {
+	    return fmt.Errorf("validate: drive without path")
+	}
+	if d.ID != "" {
+	    if drives[d.ID] {
+		return fmt.Errorf("validate: duplicate drive id %s", d.ID)
+	    }
+	    drives[d.ID] = true
+	}
+    }
+    if len(vm.NICs) != len(vm.Networks) {
+	return fmt.Errorf("validate: %d nics for %d networks", len(vm.NICs), len(vm.Networks))
+    }
+    netdevs := map[string]bool{}
+    for _, net := range vm.Networks {
+	if net.Netdev == "" {
+	    return fmt.Errorf("validate: network without netdev")
+	}
+	if netdevs[net.Netdev] {
+	    return fmt.Errorf("validate: duplicate netdev %s", net.Netdev)
+	}
+	netdevs[net.Netdev] = true
+	switch net.Type {
+	case "user", "socket", "tap", "passt":
+	default:
+	    return fmt.Errorf("validate: %s unknown network type %s", net.Netdev, net.Type)
+	}
+	if net.Type == "socket" && net.LocalIP == "" {
+	    return fmt.Errorf("validate: %s socket without address", net.Netdev)
+	}
+	if net.Type == "socket" && (net.LocalPort < 1 || net.LocalPort > 65535) {
+	    return fmt.Errorf("validate: %s socket port %d out of range", net.Netdev, net.LocalPort)
+	}
+	if inst, err := strconv.Atoi(strings.TrimPrefix(net.Netdev, "vnic")); err == nil &&
+		inst >= hostip.Stride && vm.HostIP.Mode == "offset" {
+	    return fmt.Errorf("validate: %s is beyond nic%d of hostip = offset", net.Netdev, hostip.Stride - 1)
+	}
+	if strings.ContainsAny(net.Switch, "/, ") {
+	    return fmt.Errorf("validate: %s bad switch name %s", net.Netdev, net.Switch)
+	}
+	for _, fwd := range net.HostFwds {
+	    if _, err := ParseForward(fwd); err != nil {
+		return fmt.Errorf("validate: %s %v", net.Netdev, err)
+	    }
+	}
+	if net.Type == "passt" {
+	    if vm.PasstExec == "" {
+		return fmt.Errorf("validate: %s passt without executable", net.Netdev)
+	    }
+	    if _, err := passtPorts(net.HostFwds); err != nil {
+		return fmt.Errorf("validate: %s %v", net.Netdev, err)
+	    }
+	}
+    }
+    switch vm.VNC {
+    case "", "tcp":
+	if port := vm.hostIP().DisplayPort(); port > 65535 {
+	    return fmt.Errorf("validate: vnc port %d out of range", port)
+	}
+    case "unix":
+    default:
+	return fmt.Errorf("validate: unknown vnc %s", vm.VNC)
+    }
+    for _, nic := range vm.NICs {
+	if nic.Driver == "" {
+	    return fmt.Errorf("validate: %s nic without driver", nic.Netdev)
+	}
+	if !netdevs[nic.Netdev] {
+	    return fmt.Errorf("validate: nic uses unknown netdev %s", nic.Netdev)
+	}
+    }
+    hosts := map[string]bool{}
+    for _, usbhost := range vm.USBHosts {
+	hosts[usbhost.ID] = true
+    }
+    for _, dev := range vm.USBDevices {
+	if dev.Device != "storage" {
+	    return fmt.Errorf("validate: unknown usb device %q", dev.Device)
+	}
+	if dev.Bus != "" && !hosts[dev.Bus] {
+	    return fmt.Errorf("validate: usb device on unknown bus %s", dev.Bus)
+	}
+	if !drives[dev.Drive] {
+	    return fmt.Errorf("validate: usb storage uses unknown drive %s", dev.Drive)
+	}
+    }
+    // the guest mounts shares by tag, 9p and virtiofs alike
+    tags := map[string]string{}
+    tag := func(id, path, mount_tag string) error {
+	if path == "" || mount_tag == "" {
+	    return fmt.Errorf("validate: %s needs path and tag", id)
+	}
+	if other, ok := tags[mount_tag]; ok {
+	    return fmt.Errorf("validate: %s and %s use the same tag %s", other, id, mount_tag)
+	}
+	tags[mount_tag] = id
+	return nil
+    }
+    for _, v := range vm.Virtfs {
+	if err := tag(v.ID, v.Path, v.MountTag); err != nil {
+	    return err
+	}
+	if err := v.validate(); err != nil {
+	    return err
+	}
+    }
+    for _, fs := range vm.Virtiofs {
+	if err := tag(fs.ID, fs.Path, fs.MountTag); err != nil {
+	    return err
+	}
+	if !vm.Memory.Share {
+	    return fmt.Errorf("validate: %s needs shared memory", fs.ID)
+	}
+    }
+    if len(vm.Virtiofs) > 0 && vm.VirtiofsdExec == "" {
+	return fmt.Errorf("validate: no virtiofsd")
+    }
+    if vm.Firmware.Code != "" && vm.Firmware.Vars == "" {
+	return fmt.Errorf("validate: firmware code without vars")
+    }
+    if vm.Initrd != "" && vm.Kernel == "" {
+	return fmt.Errorf("validate: initrd without kernel")
+    }
+    if err := vm.Resources.validate(); err != nil {
+	return err
+    }
+    if err := vm.validateNUMA(); err != nil {
+	return err
+    }
+    if vm.Memory.needBackend() && vm.Mem == "" {
+	return fmt.Errorf("validate: memory backend without mem size")
+    }
+    return nil
+}
@@ -9,21 +9,21 @@ import (
     "strings"
 )
 
-type drive struct {
-    path string
-    format string
-    intf string
+type Drive struct {
+    Path string `json:"path,omitempty"`
+    Format string `json:"format,omitempty"`
+    Interface string `json:"if,omitempty"`
     // bus, unit, index string
-    media string
-    id string
+    Media string `json:"media,omitempty"`
+    ID string `json:"id,omitempty"`
 }
 
-func (d *drive)value() string {
+func (d *Drive)value() string {
     v := []string{}
-    v = push(v, "file", d.path)
-    v = push(v, "format", d.format)
-    v = push(v, "if", d.intf)
-    v = push(v, "media", d.media)
-    v = push(v, "id", d.id)
+    v = push(v, "file", d.Path)
+    v = push(v, "format", d.Format)
+    v = push(v, "if", d.Interface)
+    v = push(v, "media", d.Media)
+    v = push(v, "id", d.ID)
     return strings.Join(v, ",")
 }
@@ -0,0 +1,193 @@
+// vm/qemu / forward.go
+//
+// MIT License Copyright(c) 2021 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+//
+package qemu
+
+import (
+    "fmt"
+    "sort"
+    "strconv"
+    "strings"
+
+    "vm/hostip"
+)
+
+// DefaultForwardList is used by nicN=default unless forwards is given
+const DefaultForwardList = "10022-22 10080-80 13389-3389"
+
+// Forward is a host to guest port mapping of a user network.
+// It is written like the qemu hostfwd, [tcp|udp:][hostaddr:]hostport-[guestaddr:]guestport
+type Forward struct {
+    Proto string `json:"proto"`
+    HostAddr string `json:"host_addr,omitempty"`
+    HostPort int `json:"host_port"`
+    GuestAddr string `json:"guest_addr,omitempty"`
+    GuestPort int `json:"guest_port"`
+}
+
+// String returns the forward in the qemu hostfwd format
+func (f Forward)String() string {
+    return fmt.Sprintf("%s:%s:%d-%s:%d", f.Proto, f.HostAddr, f.HostPort, f.GuestAddr, f.GuestPort)
+}
+
+// Host returns the host side, as hostfwd_remove wants it
+func (f Forward)Host() string {
+    return fmt.Sprintf("%s:%s:%d", f.Proto, f.HostAddr, f.HostPort)
+}
+
+// addrport splits [addr:]port, the addr may be empty
+func addrport(s string) (string, int, error) {
+    addr := ""
+    if i := strings.LastIndex(s, ":"); i >= 0 {
+	addr, s = s[:i], s[i+1:]
+    }
+    port, err := strconv.Atoi(s)
+    if err != nil || port < 1 || port > 65535 {
+	return "", 0, fmt.Errorf("bad port %q", s)
+    }
+    return addr, port, nil
+}
+
+func ParseForward(s string) (Forward, error) {
+    f := Forward{ Proto: "tcp" }
+    rest := s
+    for _, proto := range []string{ "tcp", "udp" } {
+	if strings.HasPrefix(rest, proto + ":") {
+	    f.Proto = proto
+	    rest = rest[len(proto)+1:]
+	}
+    }
+    a := strings.SplitN(rest, "-", 2)
+    if len(a) != 2 {
+	return f, fmt.Errorf("forward: bad %q", s)
+    }
+    var err error
+    f.HostAddr, f.HostPort, err = addrport(a[0])
+    if err != nil {
+	return f, fmt.Errorf("forward: %q %v", s, err)
+    }
+    f.GuestAddr, f.GuestPort, err = addrport(a[1])
+    if err != nil {
+	return f, fmt.Errorf("forward: %q %v", s, err)
+    }
+    return f, nil
+}
+
+// ParseForwards reads a forwards list, separated by spaces or commas
+func ParseForwards(val string) ([]Forward, error) {
+    fwds := []Forward{}
+    seen := map[string]string{}
+    for _, s := range strings.FieldsFunc(val, func(r rune) bool { return r == ' ' || r == ',' }) {
+	f, err := ParseForward(s)
+	if err != nil {
+	    return nil, err
+	}
+	if other, ok := seen[f.Host()]; ok {
+	    return nil, fmt.Errorf("forward: %s and %s use the same host port", other, s)
+	}
+	seen[f.Host()] = s
+	fwds = append(fwds, f)
+    }
+    return fwds, nil
+}
+
+// PlaceForwards puts the forwards on the address and ports of nic inst
+// as the scheme gives them, an address given stays
+func PlaceForwards(fwds []Forward, s *hostip.Scheme, inst int) []Forward {
+    placed := []Forward{}
+    for _, f := range fwds {
+	if f.HostAddr == "" {
+	    f.HostAddr = s.IP(inst)
+	}
+	f.HostPort = s.Port(inst, f.HostPort)
+	placed = append(placed, f)
+    }
+    return placed
+}
+
+// HostForwards picks the hostfwd of each user netdev in a qemu command line
+func HostForwards(args []string) map[string][]Forward {
+    fwds := map[string][]Forward{}
+    for i := 0; i + 1 < len(args); i++ {
+	if args[i] != "-netdev" {
+	    continue
+	}
+	netdev := ""
+	list := []Forward{}
+	for _, opt := range strings.Split(args[i + 1], ",") {
+	    key, val := keyval(opt)
+	    switch key {
+	    case "id": netdev = val
+	    case "hostfwd":
+		if f, err := ParseForward(val); err == nil {
+		    list = append(list, f)
+		}
+	    }
+	}
+	if len(list) > 0 {
+	    fwds[netdev] = list
+	}
+    }
+    return fwds
+}
+
+// NetForwards returns the forwards of the user and passt networks by netdev,
+// the same HostForwards and PasstForwards read back from a running VM
+func (vm *VMConfig)NetForwards() map[string][]Forward {
+    fwds := map[string][]Forward{}
+    for _, net := range vm.Networks {
+	if net.Type != "user" && net.Type != "passt" {
+	    continue
+	}
+	list := []Forward{}
+	for _, fwd := range net.HostFwds {
+	    if f, err := ParseForward(fwd); err == nil {
+		list = append(list, f)
+	    }
+	}
+	if len(list) > 0 {
+	    fwds[net.Netdev] = list
+	}
+    }
+    return fwds
+}
+
+// SSHAddr finds the host side of the forward to guest port 22,
+// the scheme guesses it when there is none
+func SSHAddr(fwds map[string][]Forward, s *hostip.Scheme) (string, int) {
+    for _, netdev := range Netdevs(fwds) {
+	for _, f := range fwds[netdev] {
+	    if f.Proto != "tcp" || f.GuestPort != 22 {
+		continue
+	    }
+	    // qemu and passt listen on any address without one
+	    if f.HostAddr == "" || f.HostAddr == "0.0.0.0" {
+		return "127.0.0.1", f.HostPort
+	    }
+	    return f.HostAddr, f.HostPort
+	}
+    }
+    return s.IP(0), s.Port(0, 10022)
+}
+
+// SSHAddr is where ssh reaches the VM once it runs
+func (vm *VMConfig)SSHAddr() (string, int) {
+    return SSHAddr(vm.NetForwards(), vm.hostIP())
+}
+
+// Netdevs returns the netdev names in order, vnic2 before vnic10
+func Netdevs(fwds map[string][]Forward) []string {
+    names := []string{}
+    for name := range fwds {
+	names = append(names, name)
+    }
+    sort.Slice(names, func(i, j int) bool {
+	if len(names[i]) != len(names[j]) {
+	    return len(names[i]) < len(names[j])
+	}
+	return names[i] < names[j]
+    })
+    return names
+}
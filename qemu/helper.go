@@ -0,0 +1,209 @@
+// vm/qemu / helper.go
+//
+// MIT License Copyright(c) 2021 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+//
+package qemu
+
+import (
+    "fmt"
+    "io/ioutil"
+    "os"
+    "os/exec"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "syscall"
+    "time"
+
+    "vm/proc"
+)
+
+// Helper is a daemon qemu connects to, like virtiofsd or passt.
+// It runs from the VM directory and leaves helper-<name>.pid there.
+type Helper struct {
+    Name string `json:"name"`
+    Exec string `json:"exec"`
+    Args []string `json:"args"`
+    // Socket appears once the helper is ready for qemu, it is <Name>.sock
+    Socket string `json:"socket"`
+}
+
+func (h *Helper)pidfile() string {
+    return "helper-" + h.Name + ".pid"
+}
+
+// Command returns the command line for showing
+func (h *Helper)Command() []string {
+    return append([]string{ h.Exec }, h.Args...)
+}
+
+// Start runs the helper in its own session, so that it outlives us when
+// qemu is daemonized, and waits for its socket
+func (h *Helper)Start(dir string) (*exec.Cmd, error) {
+    sock := filepath.Join(dir, h.Socket)
+    os.Remove(sock)
+    log, err := os.OpenFile(filepath.Join(dir, h.Name + ".log"), os.O_WRONLY | os.O_CREATE | os.O_APPEND, 0644)
+    if err != nil {
+	return nil, fmt.Errorf("%s: %v", h.Name, err)
+    }
+    defer log.Close()
+    cmd := exec.Command(h.Exec, h.Args...)
+    cmd.Dir = dir
+    cmd.Stdout = log
+    cmd.Stderr = log
+    cmd.SysProcAttr = &syscall.SysProcAttr{ Setsid: true }
+    if err := cmd.Start(); err != nil {
+	return nil, fmt.Errorf("%s: %v", h.Name, err)
+    }
+    pid := cmd.Process.Pid
+    ioutil.WriteFile(filepath.Join(dir, h.pidfile()), []byte(fmt.Sprintf("%d %s\n", pid, starttime(pid))), 0644)
+    exited := make(chan error, 1)
+    go func() {
+	exited <- cmd.Wait()
+    }()
+    deadline := time.Now().Add(5 * time.Second)
+    for {
+	if _, err := os.Stat(sock); err == nil {
+	    // keep reaping it in the background
+	    go func() {
+		err := <-exited
+		fmt.Printf("%s exited: %v\n", h.Name, err)
+	    }()
+	    return cmd, nil
+	}
+	select {
+	case err := <-exited:
+	    os.Remove(filepath.Join(dir, h.pidfile()))
+	    return nil, fmt.Errorf("%s: exited %v, see %s.log", h.Name, err, h.Name)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if time.Now().After(deadline) {
+	    cmd.Process.Kill()
+	    os.Remove(filepath.Join(dir, h.pidfile()))
+	    return nil, fmt.Errorf("%s: no socket %s", h.Name, h.Socket)
+	}
+    }
+}
+
+// starttime is when pid started in clock ticks since boot,
+// the pid with it names one process for good
+func starttime(pid int) string {
+    data, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+    if err != nil {
+	return ""
+    }
+    s := string(data)
+    // comm may have spaces, the fields after it start at state
+    f := strings.Fields(s[strings.LastIndex(s, ")") + 1:])
+    if len(f) < 20 {
+	return ""
+    }
+    return f[19]
+}
+
+// helperPid is the content of a pidfile
+type helperPid struct {
+    pid int
+    start string
+}
+
+// isHelper tells whether pid is still the helper name started from dir,
+// a pidfile outlives its helper and the pid may belong to another process by now.
+// passt moves into an empty root, so the start time tells it rather than the cwd.
+func isHelper(dir, name string, hp helperPid) bool {
+    if hp.pid <= 0 {
+	return false
+    }
+    if hp.start != "" {
+	if starttime(hp.pid) != hp.start {
+	    return false
+	}
+    } else {
+	// pidfile of an older vm
+	cwd, err := os.Readlink(fmt.Sprintf("/proc/%d/cwd", hp.pid))
+	if err != nil {
+	    return false
+	}
+	if abs, err := filepath.Abs(dir); err != nil || cwd != abs {
+	    return false
+	}
+    }
+    sock := name + ".sock"
+    for _, arg := range proc.Procread(hp.pid, "cmdline") {
+	if arg == sock || strings.HasSuffix(arg, "=" + sock) {
+	    return true
+	}
+    }
+    return false
+}
+
+// pidfiles reads the helper pidfiles in dir by name, pid 0 if unreadable
+func pidfiles(dir string) map[string]helperPid {
+    pids := map[string]helperPid{}
+    files, _ := filepath.Glob(filepath.Join(dir, "helper-*.pid"))
+    for _, file := range files {
+	name := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(file), "helper-"), ".pid")
+	hp := helperPid{}
+	if data, err := ioutil.ReadFile(file); err == nil {
+	    f := strings.Fields(string(data))
+	    if len(f) > 0 {
+		hp.pid, _ = strconv.Atoi(f[0])
+	    }
+	    if len(f) > 1 {
+		hp.start = f[1]
+	    }
+	}
+	pids[name] = hp
+    }
+    return pids
+}
+
+// HelperPids returns the pids of the running helpers by name
+func HelperPids(dir string) map[string]int {
+    pids := map[string]int{}
+    for name, hp := range pidfiles(dir) {
+	if isHelper(dir, name, hp) {
+	    pids[name] = hp.pid
+	}
+    }
+    return pids
+}
+
+// CleanHelpers removes the pidfiles left by helpers which are gone
+func CleanHelpers(dir string) {
+    for name, hp := range pidfiles(dir) {
+	if isHelper(dir, name, hp) {
+	    continue
+	}
+	h := Helper{ Name: name }
+	os.Remove(filepath.Join(dir, h.pidfile()))
+    }
+}
+
+// StopHelpers terminates the helpers started from dir
+func StopHelpers(dir string) {
+    for name, pid := range HelperPids(dir) {
+	if syscall.Kill(pid, syscall.SIGTERM) == nil {
+	    fmt.Printf("stop helper %s %d\n", name, pid)
+	}
+    }
+    for name := range pidfiles(dir) {
+	h := Helper{ Name: name }
+	os.Remove(filepath.Join(dir, h.pidfile()))
+    }
+}
+
+// Helpers lists the daemons to start before qemu
+func (vm *VMConfig)Helpers() []Helper {
+    helpers := []Helper{}
+    for _, fs := range vm.Virtiofs {
+	helpers = append(helpers, fs.helper(vm.VirtiofsdExec))
+    }
+    for _, net := range vm.Networks {
+	if net.Type == "passt" {
+	    helpers = append(helpers, net.passtHelper(vm.PasstExec))
+	}
+    }
+    return helpers
+}
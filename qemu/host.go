@@ -0,0 +1,68 @@
+// vm/qemu / host.go
+//
+// MIT License Copyright(c) 2021 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+//
+package qemu
+
+import (
+    "io/ioutil"
+    "os"
+    "path/filepath"
+
+    "vm/proc"
+)
+
+// Host is everything the config builder needs from the machine it runs on.
+// SystemHost asks the real system, tests provide their own.
+type Host struct {
+    // Files lists the names of the files under the VM directory
+    Files func(dir string) []string
+    LookupEnv func(key string) (string, bool)
+    // NSNWPid finds the pid of a running nsnw by name
+    NSNWPid func(name string) (int, bool)
+    ReadFile func(path string) ([]byte, error)
+    Stat func(path string) (os.FileInfo, error)
+    // Arch is the qemu name of the host architecture
+    Arch string
+    // KVM tells whether /dev/kvm is usable
+    KVM func() bool
+}
+
+func SystemHost() *Host {
+    return &Host{
+	Files: walkFiles,
+	LookupEnv: os.LookupEnv,
+	NSNWPid: func(name string) (int, bool) {
+	    nsnw := proc.GetNSNW(name)
+	    if nsnw == nil {
+		return 0, false
+	    }
+	    return nsnw.Pid, true
+	},
+	ReadFile: ioutil.ReadFile,
+	Stat: os.Stat,
+	Arch: hostArch(),
+	KVM: func() bool {
+	    f, err := os.OpenFile("/dev/kvm", os.O_RDWR, 0)
+	    if err != nil {
+		return false
+	    }
+	    f.Close()
+	    return true
+	},
+    }
+}
+
+func walkFiles(dir string) []string {
+    files := []string{}
+    filepath.Walk(dir,
+	func(path string, info os.FileInfo, err error) error {
+	    if err != nil {
+		return err
+	    }
+	    files = append(files, info.Name())
+	    return nil
+	});
+    return files
+}
@@ -0,0 +1,169 @@
+// vm/qemu / memory.go
+//
+// MIT License Copyright(c) 2021 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+//
+package qemu
+
+import (
+    "fmt"
+    "strconv"
+    "strings"
+)
+
+// Memory is how guest RAM is backed,
+// mem = 4G hugepages=/dev/hugepages prealloc share=on balloon
+type Memory struct {
+    HugePages string `json:"hugepages,omitempty"`
+    Prealloc bool `json:"prealloc"`
+    // Share maps the RAM shared, vhost-user and virtiofs need it
+    Share bool `json:"share"`
+}
+
+func (m *Memory)needBackend() bool {
+    return m.HugePages != "" || m.Prealloc || m.Share
+}
+
+// backend returns the -object for a RAM region of size
+func (m *Memory)backend(id, size, hostnodes string) string {
+    v := []string{}
+    switch {
+    case m.HugePages != "":
+	v = append(v, "memory-backend-file")
+    case m.Share:
+	v = append(v, "memory-backend-memfd")
+    default:
+	v = append(v, "memory-backend-ram")
+    }
+    v = push(v, "id", id)
+    v = push(v, "size", size)
+    v = push(v, "mem-path", m.HugePages)
+    if m.Share {
+	v = push(v, "share", "on")
+    }
+    if m.Prealloc {
+	v = push(v, "prealloc", "on")
+    }
+    if hostnodes != "" {
+	v = push(v, "host-nodes", hostnodes)
+	v = push(v, "policy", "bind")
+    }
+    return strings.Join(v, ",")
+}
+
+// parseSize parses qemu style sizes, a plain number is MiB like -m
+func parseSize(s string) (uint64, error) {
+    if s == "" {
+	return 0, fmt.Errorf("empty size")
+    }
+    unit := uint64(1) << 20
+    switch s[len(s) - 1] {
+    case 'K', 'k': unit = 1 << 10
+    case 'M', 'm': unit = 1 << 20
+    case 'G', 'g': unit = 1 << 30
+    case 'T', 't': unit = 1 << 40
+    }
+    num := s
+    if s[len(s) - 1] < '0' || s[len(s) - 1] > '9' {
+	num = s[:len(s) - 1]
+    }
+    n, err := strconv.ParseUint(num, 10, 64)
+    if err == nil {
+	return n * unit, nil
+    }
+    // qemu takes fractions like 1.5G too
+    f, err := strconv.ParseFloat(num, 64)
+    if err != nil || f < 0 {
+	return 0, fmt.Errorf("bad size %q", s)
+    }
+    return uint64(f * float64(unit)), nil
+}
+
+// memSize is the size part of mem, 4G,slots=2,maxmem=8G has 4G
+func memSize(mem string) string {
+    size := strings.Split(mem, ",")[0]
+    return strings.TrimPrefix(size, "size=")
+}
+
+// parseMem handles mem, the size alone keeps working as before
+// and anything else goes to -m as it is
+func (vm *VMConfig)parseMem(val string) error {
+    for _, param := range strings.Fields(val) {
+	key, v := keyval(param)
+	on := v == "" || v == "on" || v == "1"
+	switch key {
+	case "size": vm.Mem = v
+	case "hugepages":
+	    vm.Memory.HugePages = v
+	    if v == "" {
+		vm.Memory.HugePages = "/dev/hugepages"
+	    }
+	case "prealloc": vm.Memory.Prealloc = on
+	case "share": vm.Memory.Share = on
+	case "balloon": vm.Balloon = on
+	default:
+	    if v != "" && !strings.Contains(key, ",") {
+		return fmt.Errorf("mem: unknown %s", param)
+	    }
+	    vm.Mem = param
+	}
+    }
+    return nil
+}
+
+// memory emits the RAM backend unless NUMA nodes carry it
+func (vm *VMConfig)memory() {
+    if len(vm.NUMA) > 0 {
+	vm.numa()
+    } else if vm.Memory.needBackend() && vm.Mem != "" {
+	vm.push("-object", vm.Memory.backend("ram0", memSize(vm.Mem), ""))
+	vm.push("-numa", "node,memdev=ram0")
+    }
+    if vm.Balloon {
+	vm.push("-device", "virtio-balloon")
+    }
+}
+
+// meminfo reads a kB value from /proc/meminfo
+func meminfo(data, key string) (uint64, bool) {
+    for _, line := range strings.Split(data, "\n") {
+	f := strings.Fields(line)
+	if len(f) < 2 || f[0] != key + ":" {
+	    continue
+	}
+	n, err := strconv.ParseUint(f[1], 10, 64)
+	return n, err == nil
+    }
+    return 0, false
+}
+
+// Check looks at the host for what the configuration needs before launch
+func (vm *VMConfig)Check() error {
+    if err := vm.checkHugepages(); err != nil {
+	return err
+    }
+    return vm.checkShares()
+}
+
+func (vm *VMConfig)checkHugepages() error {
+    if vm.Memory.HugePages == "" {
+	return nil
+    }
+    data, err := vm.host.ReadFile("/proc/meminfo")
+    if err != nil {
+	return fmt.Errorf("check: %v", err)
+    }
+    free, ok1 := meminfo(string(data), "HugePages_Free")
+    size, ok2 := meminfo(string(data), "Hugepagesize")
+    if !ok1 || !ok2 {
+	return fmt.Errorf("check: no hugepages in /proc/meminfo")
+    }
+    need, err := parseSize(memSize(vm.Mem))
+    if err != nil {
+	return fmt.Errorf("check: mem %v", err)
+    }
+    if avail := free * size << 10; avail < need {
+	return fmt.Errorf("check: %s needed but %d MiB of hugepages free", vm.Mem, avail >> 20)
+    }
+    return nil
+}
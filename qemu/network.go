@@ -10,59 +10,82 @@ import (
     "strings"
 )
 
-type nic struct {
-    driver string
-    netdev string
-    mac string
+// SocketPort is where a socket netdev listens by default
+const SocketPort = 1111
+
+type NIC struct {
+    Driver string `json:"driver"`
+    Netdev string `json:"netdev"`
+    MAC string `json:"mac,omitempty"`
 }
 
-func (n *nic)value() string {
-    v := []string{ n.driver }
-    v = push(v, "netdev", n.netdev)
-    v = push(v, "mac", n.mac)
+func (n *NIC)value() string {
+    v := []string{ n.Driver }
+    v = push(v, "netdev", n.Netdev)
+    v = push(v, "mac", n.MAC)
     return strings.Join(v, ",")
 }
 
-type network struct {
-    nettype string
-    netdev string
+// NSNWLink is a tap device inside a nsnw network namespace
+type NSNWLink struct {
+    Name string `json:"name,omitempty"`
+    Path string `json:"path,omitempty"`
+    Bridge string `json:"bridge,omitempty"`
+    Pid string `json:"pid"`
+    Tap string `json:"tap"`
+    TapFD string `json:"tapfd,omitempty"`
+}
+
+type Network struct {
+    Type string `json:"type"`
+    Netdev string `json:"netdev"`
     // user
-    hostfwds []string // like tcp:127.0.0.1:10080-:80
-    guestfwds []string
-    proxy string
-    restrict string
+    HostFwds []string `json:"hostfwds,omitempty"` // like tcp:127.0.0.1:10080-:80
+    GuestFwds []string `json:"guestfwds,omitempty"`
+    Proxy string `json:"proxy,omitempty"`
+    Restrict string `json:"restrict,omitempty"`
     // socket
-    localIP string
+    LocalIP string `json:"local_ip,omitempty"`
+    LocalPort int `json:"local_port,omitempty"`
+    // Switch is the tools/sw instance to plug the socket into
+    Switch string `json:"switch,omitempty"`
+    // passt
+    Socket string `json:"socket,omitempty"`
     // tap
-    ifname string
+    Ifname string `json:"ifname,omitempty"`
     // nsnw
-    nsnwopt string
-    nsnwname, nsnwpath, nsnwbr string
-    nsnwpid, nsnwtap string
-    nsnwtapfd string
+    NSNW *NSNWLink `json:"nsnw,omitempty"`
 }
 
-func (n *network)value() string {
-    v := []string{ n.nettype }
-    v = push(v, "id", n.netdev)
+func (n *Network)value() string {
+    typ := n.Type
+    if typ == "passt" {
+	typ = "stream"
+    }
+    v := []string{ typ }
+    v = push(v, "id", n.Netdev)
     // user
-    switch n.nettype {
+    switch n.Type {
     case "user":
-	for _, fwd := range n.hostfwds {
+	for _, fwd := range n.HostFwds {
 	    v = push(v, "hostfwd", fwd)
 	}
-	for _, fwd := range n.guestfwds {
+	for _, fwd := range n.GuestFwds {
 	    f := strings.Replace(fwd, "+", " ", -1)
 	    v = push(v, "guestfwd", f)
 	}
-	v = push(v, "proxy", n.proxy)
-	v = push(v, "restrict", n.restrict)
+	v = push(v, "proxy", n.Proxy)
+	v = push(v, "restrict", n.Restrict)
     case "socket":
-	v = push(v, "listen", fmt.Sprintf("%s:1111", n.localIP))
+	v = push(v, "listen", n.listen())
+    case "passt":
+	v = push(v, "server", "off")
+	v = push(v, "addr.type", "unix")
+	v = push(v, "addr.path", n.Socket)
     case "tap":
-	v = push(v, "ifname", n.ifname)
-	if n.nsnwtapfd != "" {
-	    v = push(v, "fd", n.nsnwtapfd)
+	v = push(v, "ifname", n.Ifname)
+	if n.NSNW != nil && n.NSNW.TapFD != "" {
+	    v = push(v, "fd", n.NSNW.TapFD)
 	} else {
 	    v = push(v, "script", "no")
 	    v = push(v, "downscript", "no")
@@ -72,3 +95,55 @@ func (n *network)value() string {
     }
     return strings.Join(v, ",")
 }
+
+func (n *Network)listen() string {
+    port := n.LocalPort
+    if port == 0 {
+	port = SocketPort
+    }
+    return fmt.Sprintf("%s:%d", n.LocalIP, port)
+}
+
+// SwitchPort is a socket netdev the switch dials after launch
+type SwitchPort struct {
+    Switch string `json:"switch"`
+    Port string `json:"port"`
+    Addr string `json:"addr"`
+}
+
+// SwitchPorts lists the socket netdevs with a switch, the port is
+// named after the VM and the netdev
+func (vm *VMConfig)SwitchPorts() []SwitchPort {
+    ports := []SwitchPort{}
+    for _, net := range vm.Networks {
+	if net.Type != "socket" || net.Switch == "" {
+	    continue
+	}
+	ports = append(ports, SwitchPort{
+	    Switch: net.Switch,
+	    Port: vm.Name + "." + net.Netdev,
+	    Addr: net.listen(),
+	})
+    }
+    return ports
+}
+
+// SwitchEnv is VM_SWITCHES, switch/port separated by commas
+func SwitchEnv(ports []SwitchPort) string {
+    a := []string{}
+    for _, p := range ports {
+	a = append(a, p.Switch + "/" + p.Port)
+    }
+    return strings.Join(a, ",")
+}
+
+// ParseSwitchEnv reads VM_SWITCHES back, without the addresses
+func ParseSwitchEnv(env string) []SwitchPort {
+    ports := []SwitchPort{}
+    for _, sp := range strings.Split(env, ",") {
+	if a := strings.SplitN(sp, "/", 2); len(a) == 2 {
+	    ports = append(ports, SwitchPort{ Switch: a[0], Port: a[1] })
+	}
+    }
+    return ports
+}
@@ -12,11 +12,13 @@ import (
 
 type nsnw struct {
     pidmap map[string]string
+    host *Host
 }
 
-func newnsnw() *nsnw {
+func newnsnw(host *Host) *nsnw {
     nsnw := &nsnw{
 	pidmap: map[string]string{},
+	host: host,
     }
     return nsnw
 }
@@ -27,18 +29,18 @@ func (nsnw *nsnw)getpid(path string) string {
 	return pid
     }
     // read
-    f, err := os.Open(path)
+    buf, err := nsnw.host.ReadFile(path)
     if err != nil {
-	fmt.Printf("unable to open pid file %s\n", path)
+	fmt.Fprintf(os.Stderr, "unable to open pid file %s\n", path)
 	return ""
     }
-    defer f.Close()
-    buf := make([]byte, 32)
-    n, err := f.Read(buf)
-    if n == 0 {
-	fmt.Printf("unable to find pid in file %s\n", path)
+    if len(buf) > 32 {
+	buf = buf[:32]
+    }
+    if len(buf) == 0 {
+	fmt.Fprintf(os.Stderr, "unable to find pid in file %s\n", path)
 	return ""
     }
-    nsnw.pidmap[path] = string(buf[:n])
+    nsnw.pidmap[path] = string(buf)
     return nsnw.pidmap[path]
 }
@@ -0,0 +1,148 @@
+// vm/qemu / numa.go
+//
+// MIT License Copyright(c) 2021 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+//
+package qemu
+
+import (
+    "fmt"
+    "strconv"
+    "strings"
+)
+
+// NUMANode is a guest node, numa = cpus=0-1,mem=2G,host=0 cpus=2-3,mem=2G,host=1
+type NUMANode struct {
+    CPUs string `json:"cpus"`
+    Mem string `json:"mem"`
+    // HostNodes binds the node memory to these host nodes
+    HostNodes string `json:"host,omitempty"`
+}
+
+// CPUPin pins vCPU to the host cpus
+type CPUPin struct {
+    VCPU int `json:"vcpu"`
+    Host []int `json:"host"`
+}
+
+// parseCPUs parses a cpu list like 0-3,8
+func parseCPUs(s string) ([]int, error) {
+    cpus := []int{}
+    for _, r := range strings.Split(s, ",") {
+	a := strings.SplitN(r, "-", 2)
+	lo, err := strconv.Atoi(a[0])
+	if err != nil {
+	    return nil, fmt.Errorf("bad cpu list %q", s)
+	}
+	hi := lo
+	if len(a) == 2 {
+	    if hi, err = strconv.Atoi(a[1]); err != nil || hi < lo {
+		return nil, fmt.Errorf("bad cpu list %q", s)
+	    }
+	}
+	for c := lo; c <= hi; c++ {
+	    cpus = append(cpus, c)
+	}
+    }
+    return cpus, nil
+}
+
+// parseCPUPin parses cpupin, either a host cpu list used in vCPU order
+// (cpupin = 2-5) or vcpu:cpus pairs (cpupin = 0:2 1:3 2:4-5)
+func parseCPUPin(val string) ([]CPUPin, error) {
+    pins := []CPUPin{}
+    params := strings.Fields(val)
+    if len(params) == 1 && !strings.Contains(params[0], ":") {
+	cpus, err := parseCPUs(params[0])
+	if err != nil {
+	    return nil, fmt.Errorf("cpupin: %v", err)
+	}
+	for i, c := range cpus {
+	    pins = append(pins, CPUPin{ VCPU: i, Host: []int{c} })
+	}
+	return pins, nil
+    }
+    for _, param := range params {
+	a := strings.SplitN(param, ":", 2)
+	if len(a) != 2 {
+	    return nil, fmt.Errorf("cpupin: bad %q", param)
+	}
+	vcpu, err := strconv.Atoi(a[0])
+	if err != nil {
+	    return nil, fmt.Errorf("cpupin: bad vcpu %q", param)
+	}
+	cpus, err := parseCPUs(a[1])
+	if err != nil {
+	    return nil, fmt.Errorf("cpupin: %v", err)
+	}
+	pins = append(pins, CPUPin{ VCPU: vcpu, Host: cpus })
+    }
+    return pins, nil
+}
+
+func parseNUMA(val string) ([]NUMANode, error) {
+    nodes := []NUMANode{}
+    for _, param := range strings.Fields(val) {
+	node := NUMANode{}
+	for _, kv := range strings.Split(param, ",") {
+	    key, v := keyval(kv)
+	    switch key {
+	    case "cpus": node.CPUs = v
+	    case "mem": node.Mem = v
+	    case "host": node.HostNodes = v
+	    default:
+		// cpus=0,2 or cpus=0-1,4
+		if node.CPUs != "" && v == "" {
+		    node.CPUs += "," + key
+		    continue
+		}
+		return nil, fmt.Errorf("numa: unknown %q", kv)
+	    }
+	}
+	if node.CPUs == "" || node.Mem == "" {
+	    return nil, fmt.Errorf("numa: node needs cpus and mem %q", param)
+	}
+	nodes = append(nodes, node)
+    }
+    return nodes, nil
+}
+
+func (vm *VMConfig)validateNUMA() error {
+    if len(vm.NUMA) == 0 {
+	return nil
+    }
+    total := uint64(0)
+    for i, node := range vm.NUMA {
+	if _, err := parseCPUs(node.CPUs); err != nil {
+	    return fmt.Errorf("validate: numa node %d %v", i, err)
+	}
+	size, err := parseSize(node.Mem)
+	if err != nil {
+	    return fmt.Errorf("validate: numa node %d %v", i, err)
+	}
+	total += size
+    }
+    mem, err := parseSize(memSize(vm.Mem))
+    if err != nil {
+	return fmt.Errorf("validate: mem %v", err)
+    }
+    if mem != total {
+	return fmt.Errorf("validate: mem %s does not match numa nodes", vm.Mem)
+    }
+    return nil
+}
+
+// numa emits a memory backend and a node for each NUMA node
+func (vm *VMConfig)numa() {
+    for i, node := range vm.NUMA {
+	id := fmt.Sprintf("numa%d", i)
+	vm.push("-object", vm.Memory.backend(id, node.Mem, node.HostNodes))
+	n := []string{ "node" }
+	n = push(n, "nodeid", strconv.Itoa(i))
+	for _, cpus := range strings.Split(node.CPUs, ",") {
+	    n = push(n, "cpus", cpus)
+	}
+	n = push(n, "memdev", id)
+	vm.push("-numa", strings.Join(n, ","))
+    }
+}
@@ -0,0 +1,77 @@
+// vm/qemu / passt.go
+//
+// MIT License Copyright(c) 2021 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+//
+package qemu
+
+import (
+    "fmt"
+    "strings"
+)
+
+// nicN = passt runs the user network in passt instead of slirp,
+// qemu talks to it over passtN.sock with -netdev stream
+
+func passtSocket(netdev string) string {
+    return strings.Replace(netdev, "vnic", "passt", 1) + ".sock"
+}
+
+// passtPorts maps hostfwd to the passt -t and -u options,
+// tcp:127.0.0.1:10022-:22 becomes -t 127.0.0.1/10022:22
+func passtPorts(fwds []string) ([]string, error) {
+    opts := []string{}
+    for _, fwd := range fwds {
+	f, err := ParseForward(fwd)
+	if err != nil {
+	    return nil, err
+	}
+	if f.GuestAddr != "" {
+	    return nil, fmt.Errorf("passt forwards to the guest address only %q", fwd)
+	}
+	port := fmt.Sprintf("%d:%d", f.HostPort, f.GuestPort)
+	if f.HostAddr != "" {
+	    port = f.HostAddr + "/" + port
+	}
+	opt := "-t"
+	if f.Proto == "udp" {
+	    opt = "-u"
+	}
+	opts = append(opts, opt, port)
+    }
+    return opts, nil
+}
+
+// PasstForwards reads the forwards back from a passt command line
+func PasstForwards(args []string) []Forward {
+    fwds := []Forward{}
+    for i := 0; i + 1 < len(args); i++ {
+	proto := ""
+	switch args[i] {
+	case "-t": proto = "tcp"
+	case "-u": proto = "udp"
+	default: continue
+	}
+	port := args[i + 1]
+	addr := ""
+	if a := strings.SplitN(port, "/", 2); len(a) == 2 {
+	    addr, port = a[0], a[1]
+	}
+	f, err := ParseForward(fmt.Sprintf("%s:%s:%s", proto, addr, strings.Replace(port, ":", "-:", 1)))
+	if err == nil {
+	    fwds = append(fwds, f)
+	}
+    }
+    return fwds
+}
+
+func (n *Network)passtHelper(passt string) Helper {
+    cmd := strings.Fields(passt)
+    // --one-off lets passt go away once qemu has connected and left,
+    // the reaper and vm stop take care of the rest
+    args := append(cmd[1:], "--foreground", "--one-off", "--socket", n.Socket)
+    ports, _ := passtPorts(n.HostFwds)
+    args = append(args, ports...)
+    name := strings.TrimSuffix(n.Socket, ".sock")
+    return Helper{ Name: name, Exec: cmd[0], Args: args, Socket: n.Socket }
+}
@@ -11,12 +11,25 @@ import (
     "os"
     "os/exec"
     "path/filepath"
+    "sort"
     "strconv"
     "strings"
 
-    "vm/proc"
+    "vm/hostip"
 )
 
+// PidFile is written by qemu in the VM directory
+const PidFile = "qemu.pid"
+
+// QMPSocket is the QMP socket created in the VM directory
+const QMPSocket = "qmp.sock"
+
+// VNCSocket is the vnc server socket with vnc = unix
+const VNCSocket = "vnc.sock"
+
+// GuestAgentSocket is where the qemu guest agent channel is connected
+const GuestAgentSocket = "qga.sock"
+
 func push(a []string, k, v string) []string {
     if v == "" {
 	return a
@@ -32,76 +45,85 @@ func keyval(s string) (string, string) {
     return strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
 }
 
-type virtfs struct {
-    driver string
-    id string
-    path string
-    mount_tag string
-    security_model string
-    readonly bool
-}
-
-func (f *virtfs)value() string {
-    v := []string{ f.driver }
-    v = push(v, "id", f.id)
-    v = push(v, "path", f.path)
-    v = push(v, "mount_tag", f.mount_tag)
-    v = push(v, "security_model", f.security_model)
-    if f.readonly {
-	v = append(v, "readonly")
-    }
-    return strings.Join(v, ",")
-}
-
-type ovmf struct {
-    code, vars string
+type Firmware struct {
+    Code string `json:"code,omitempty"`
+    Vars string `json:"vars,omitempty"`
 }
 
 type VMConfig struct {
-    dir string
-    name string
-    id int
-    cpu, smp, mem string
-    defaults bool
-    localtime bool
-    drives []drive
-    hd0 drive
-    nics []nic
-    networks []network
-    serial string
-    sound string
-    tablet string
-    vga string
+    Dir string `json:"dir"`
+    Name string `json:"name"`
+    ID int `json:"id"`
+    Arch string `json:"arch"`
+    Machine string `json:"machine,omitempty"`
+    Accel string `json:"accel,omitempty"`
+    CPU string `json:"cpu,omitempty"`
+    SMP string `json:"smp,omitempty"`
+    Mem string `json:"mem,omitempty"`
+    Memory Memory `json:"memory"`
+    Balloon bool `json:"balloon"`
+    Defaults bool `json:"defaults"`
+    Localtime bool `json:"localtime"`
+    Drives []Drive `json:"drives"`
+    // hdN options replace the hdN.qcow2 or hdN.raw found in the directory
+    hds map[int]Drive
+    NICs []NIC `json:"nics"`
+    // HostIP places the host side addresses and ports
+    HostIP *hostip.Scheme `json:"hostip"`
+    // VNC is tcp or unix
+    VNC string `json:"vnc,omitempty"`
+    // Forwards are the host to guest ports of nicN=default
+    Forwards []Forward `json:"forwards"`
+    Networks []Network `json:"networks"`
+    Serial string `json:"serial,omitempty"`
+    Sound string `json:"sound,omitempty"`
+    Tablet string `json:"tablet,omitempty"`
+    VGA string `json:"vga,omitempty"`
     // usb
-    usbhosts []usbhost
-    usbdevs []usb
+    USBHosts []USBHost `json:"usbhosts"`
+    USBDevices []USBDevice `json:"usbdevices"`
     //display string
-    noreboot bool
-    bootmenu string
-    virtfs []virtfs
-    ovmf ovmf
+    NoReboot bool `json:"noreboot"`
+    BootMenu string `json:"bootmenu,omitempty"`
+    Virtfs []Virtfs `json:"virtfs"`
+    Virtiofs []Virtiofs `json:"virtiofs,omitempty"`
+    VirtiofsdExec string `json:"virtiofsd,omitempty"`
+    PasstExec string `json:"passt,omitempty"`
+    Firmware Firmware `json:"firmware"`
     //
-    kernel, initrd, cmdline string
+    Kernel string `json:"kernel,omitempty"`
+    Initrd string `json:"initrd,omitempty"`
+    Cmdline string `json:"append,omitempty"`
     //
-    qemuexec string
+    QemuExec string `json:"qemu"`
+    GuestAgent bool `json:"guestagent"`
+    Resources Resources `json:"resources"`
+    NUMA []NUMANode `json:"numa,omitempty"`
+    CPUPin []CPUPin `json:"cpupin,omitempty"`
+    // stay in the foreground instead of -daemonize
+    Foreground bool `json:"foreground"`
     //
     nsnw *nsnw
+    host *Host
     //
     opts map[string]string
+    // quiet does not echo the options
+    quiet bool
     //
     args []string
 }
 
 func (vm *VMConfig)Prepare() *exec.Cmd {
     // check tap
-    for _, net := range vm.networks {
-	if net.nsnwpid == "" {
+    for _, net := range vm.Networks {
+	ns := net.NSNW
+	if ns == nil {
 	    continue
 	}
-	if net.nsnwtapfd != "" {
+	if ns.TapFD != "" {
 	    continue
 	}
-	args := []string{net.nsnwpid, net.nsnwtap}
+	args := []string{ns.Pid, ns.Tap}
 	args = append(args, os.Args...)
 	fmt.Printf("prepare nstap %v\n", args)
 	return exec.Command("nstap", args...)
@@ -114,91 +136,146 @@ func (vm *VMConfig)Post() []*exec.Cmd {
     add_nsexec := func(args ...string) []*exec.Cmd {
 	return append(cmds, exec.Command("nsexec", args...))
     }
-    for _, net := range vm.networks {
-	if net.nsnwpid == "" {
+    for _, net := range vm.Networks {
+	ns := net.NSNW
+	if ns == nil {
 	    continue
 	}
 	// ip link add <bridge> type bridge
-	cmds = add_nsexec(net.nsnwpid, "ip", "link", "add", net.nsnwbr, "type", "bridge")
+	cmds = add_nsexec(ns.Pid, "ip", "link", "add", ns.Bridge, "type", "bridge")
 	// ip link set <bridge> up
-	cmds = add_nsexec(net.nsnwpid, "ip", "link", "set", net.nsnwbr, "up")
+	cmds = add_nsexec(ns.Pid, "ip", "link", "set", ns.Bridge, "up")
 	// ip link set <tapname> master <bridge>
-	cmds = add_nsexec(net.nsnwpid, "ip", "link", "set", net.nsnwtap, "master", net.nsnwbr)
+	cmds = add_nsexec(ns.Pid, "ip", "link", "set", ns.Tap, "master", ns.Bridge)
 	// ip link set <tapname> up
-	cmds = add_nsexec(net.nsnwpid, "ip", "link", "set", net.nsnwtap, "up")
+	cmds = add_nsexec(ns.Pid, "ip", "link", "set", ns.Tap, "up")
     }
     return cmds
 }
 
 func (vm *VMConfig)Qemu() *exec.Cmd {
     vm.args = []string{}
-    vm.push("-name", vm.name)
-    vm.pushif("-cpu", vm.cpu)
-    vm.pushif("-smp", vm.smp)
-    vm.pushif("-m", vm.mem)
-    vm.push("-boot", vm.bootmenu)
-    if !vm.defaults {
+    vm.push("-name", vm.Name)
+    vm.pushif("-machine", vm.machine())
+    vm.pushif("-cpu", vm.CPU)
+    vm.pushif("-smp", vm.SMP)
+    vm.pushif("-m", vm.Mem)
+    vm.memory()
+    vm.push("-boot", vm.BootMenu)
+    if !vm.Defaults {
 	vm.push("-nodefaults")
     }
-    if vm.localtime {
+    if vm.Localtime {
 	vm.push("-localtime")
     }
-    for _, drive := range vm.drives {
+    for _, drive := range vm.Drives {
 	vm.push("-drive", drive.value())
     }
-    for _, nic := range vm.nics {
+    for _, nic := range vm.NICs {
 	vm.push("-device", nic.value())
     }
-    for _, net := range vm.networks {
+    for _, net := range vm.Networks {
 	vm.push("-netdev", net.value())
     }
-    for _, usbhost := range vm.usbhosts {
-	vm.push("-device", "qemu-xhci,id=" + usbhost.id)
+    for _, usbhost := range vm.USBHosts {
+	vm.push("-device", "qemu-xhci,id=" + usbhost.ID)
     }
-    for _, usbdev := range vm.usbdevs {
+    for _, usbdev := range vm.USBDevices {
 	vm.push("-device", usbdev.value())
     }
-    for _, virtfs := range vm.virtfs {
+    for _, virtfs := range vm.Virtfs {
 	vm.push("-virtfs", virtfs.value())
     }
-    if vm.ovmf.code != "" {
-	vm.push("-drive", "if=pflash,format=raw,readonly,file=" + vm.ovmf.code)
+    vm.virtiofs()
+    if vm.GuestAgent {
+	vm.push("-chardev", "socket,path=" + GuestAgentSocket + ",server,nowait,id=qga0")
+	vm.push("-device", "virtio-serial")
+	vm.push("-device", "virtserialport,chardev=qga0,name=org.qemu.guest_agent.0")
+    }
+    if vm.Firmware.Code != "" {
+	vm.push("-drive", "if=pflash,format=raw,readonly,file=" + vm.Firmware.Code)
     }
-    if vm.ovmf.vars != "" {
-	vm.push("-drive", "if=pflash,format=raw,file=" + vm.ovmf.vars)
+    if vm.Firmware.Vars != "" {
+	vm.push("-drive", "if=pflash,format=raw,file=" + vm.Firmware.Vars)
     }
-    if vm.noreboot {
+    if vm.NoReboot {
 	vm.push("-no-reboot")
     }
-    if vm.kernel != "" {
-	vm.push("-kernel", vm.kernel)
-	vm.pushif("-initrd", vm.initrd)
-	vm.pushif("-append", vm.cmdline)
-    }
-    vm.push("-serial", vm.serial)
-    vm.pushif("-soundhw", vm.sound)
-    vm.pushif("-usbdevice", vm.tablet)
-    vm.pushif("-vga", vm.vga)
-    // display vnc=:id
-    vm.push("-display", fmt.Sprintf("vnc=%s:0", vm.localIP(0)))
+    if vm.Kernel != "" {
+	vm.push("-kernel", vm.Kernel)
+	vm.pushif("-initrd", vm.Initrd)
+	vm.pushif("-append", vm.Cmdline)
+    }
+    vm.push("-serial", vm.Serial)
+    vm.pushif("-soundhw", vm.Sound)
+    vm.pushif("-usbdevice", vm.Tablet)
+    vm.pushif("-vga", vm.VGA)
+    // display vnc=ip:0 or on the unix socket
+    if vm.VNC == "unix" {
+	vm.push("-display", "vnc=unix:" + VNCSocket)
+    } else {
+	vm.push("-display", "vnc=" + vm.hostIP().Display())
+    }
     // always on
-    vm.push("-enable-kvm")
-    vm.push("-daemonize")
-    vm.push("-pidfile", "qemu.pid")
+    if !vm.Foreground {
+	vm.push("-daemonize")
+    }
+    vm.push("-pidfile", PidFile)
     vm.push("-monitor", "vc")
-    fmt.Println(vm.args)
-    // env
+    vm.push("-qmp", "unix:" + QMPSocket + ",server,nowait")
+
+    cmd := exec.Command(vm.QemuExec, vm.args...)
+    cmd.Env = append(os.Environ(), vm.Env()...)
+    return cmd
+}
+
+// Env returns the VM_* variables passed to qemu, proc uses them to find the VM
+func (vm *VMConfig)Env() []string {
     env := []string{
-	fmt.Sprintf("VM_ID=%d", vm.id),
-	fmt.Sprintf("VM_NAME=%s", vm.name),
-	fmt.Sprintf("VM_DIR=%s", vm.dir),
+	fmt.Sprintf("VM_ID=%d", vm.ID),
+	fmt.Sprintf("VM_NAME=%s", vm.Name),
+	fmt.Sprintf("VM_DIR=%s", vm.Dir),
 	fmt.Sprintf("VM_LOCAL_NET=%s", vm.localIP(0)),
     }
-    fmt.Println(env)
+    // no VM_HOSTIP means loopback
+    if vm.HostIP.Mode != "loopback" {
+	env = append(env, fmt.Sprintf("VM_HOSTIP=%s", vm.HostIP))
+    }
+    // stop unplugs these
+    if ports := vm.SwitchPorts(); len(ports) > 0 {
+	env = append(env, fmt.Sprintf("VM_SWITCHES=%s", SwitchEnv(ports)))
+    }
+    return env
+}
 
-    cmd := exec.Command(vm.qemuexec, vm.args...)
-    cmd.Env = append(os.Environ(), env...)
-    return cmd
+// ShellQuote joins args into a line that can be pasted into sh
+func ShellQuote(args []string) string {
+    quoted := []string{}
+    for _, arg := range args {
+	quoted = append(quoted, shellquote(arg))
+    }
+    return strings.Join(quoted, " ")
+}
+
+func shellquote(s string) string {
+    if s == "" {
+	return "''"
+    }
+    safe := true
+    for _, c := range s {
+	if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' {
+	    continue
+	}
+	if strings.ContainsRune("-_./:,=+@%", c) {
+	    continue
+	}
+	safe = false
+	break
+    }
+    if safe {
+	return s
+    }
+    return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
 }
 
 func (vm *VMConfig)push(args ...string) {
@@ -211,88 +288,104 @@ func (vm *VMConfig)pushif(opt, arg string) {
     }
 }
 
+// hostIP is the scheme for this VM id
+func (vm *VMConfig)hostIP() *hostip.Scheme {
+    s := *vm.HostIP
+    s.ID = vm.ID
+    return &s
+}
+
 func (vm *VMConfig)localIP(inst int) string {
-    id8h := vm.id / 256
-    id8l := vm.id % 256
-    return fmt.Sprintf("127.%d.%d.%d", id8h, id8l, inst)
+    return vm.hostIP().IP(inst)
 }
 
 func (vm *VMConfig)plug(device interface{}) {
 }
 
 func (vm *VMConfig)localSetup() {
-    // hd0.qcow2 or hd0.raw
-    hd0, hd1 := drive{}, drive{}
+    // hdN.qcow2 or hdN.raw
+    hds := map[int]Drive{}
     // ovmf
     ovmf, ovmf_code, ovmf_vars := "", "", ""
-    filepath.Walk(".",
-	func(path string, info os.FileInfo, err error) error {
-	    if err != nil {
-		return err
-	    }
-	    file := info.Name()
-	    // OVMF.fd?
-	    switch file {
-	    case "OVMF.fd": ovmf = file
-	    case "OVMF_CODE.fd": ovmf_code = file
-	    case "OVMF_VARS.fd": ovmf_vars = file
-	    }
-	    a := strings.Split(info.Name(), ".")
-	    if len(a) != 2 {
-		return nil
-	    }
-	    name := a[0]
-	    ext := a[1]
-	    if ext != "qcow2" && ext != "raw" {
-		return nil
-	    }
-	    switch name {
-	    case "hd0": hd0 = drive{ path: info.Name(), intf: "virtio", format: ext }
-	    case "hd1": hd1 = drive{ path: info.Name(), intf: "virtio", format: ext }
-	    }
-	    return nil
-	});
-    if vm.hd0.path != "" {
-	vm.drives = append(vm.drives, vm.hd0)
-    } else {
-	if hd0.path != "" {
-	    vm.drives = append(vm.drives, hd0)
+    for _, file := range vm.host.Files(vm.Dir) {
+	// OVMF.fd?
+	switch file {
+	case "OVMF.fd": ovmf = file
+	case "OVMF_CODE.fd": ovmf_code = file
+	case "OVMF_VARS.fd": ovmf_vars = file
+	case "AAVMF_CODE.fd": if vm.Arch == "aarch64" { ovmf_code = file }
+	case "AAVMF_VARS.fd": if vm.Arch == "aarch64" { ovmf_vars = file }
+	}
+	a := strings.Split(file, ".")
+	if len(a) != 2 {
+	    continue
+	}
+	name := a[0]
+	ext := a[1]
+	if ext != "qcow2" && ext != "raw" {
+	    continue
+	}
+	family, n, ok, err := instance(name)
+	if !ok || err != nil || family != "hd" {
+	    continue
 	}
+	hds[n] = Drive{ Path: file, Interface: "virtio", Format: ext }
     }
-    if hd1.path != "" {
-	vm.drives = append(vm.drives, hd1)
+    for n, hd := range vm.hds {
+	if hd.Path != "" {
+	    hds[n] = hd
+	}
+    }
+    idx := []int{}
+    for n := range hds {
+	idx = append(idx, n)
+    }
+    sort.Ints(idx)
+    for _, n := range idx {
+	vm.Drives = append(vm.Drives, hds[n])
     }
     if ovmf_code != "" && ovmf_vars != "" {
-	vm.ovmf.code = ovmf_code
-	vm.ovmf.vars = ovmf_vars
+	vm.Firmware.Code = ovmf_code
+	vm.Firmware.Vars = ovmf_vars
     } else if ovmf != "" {
-	vm.ovmf.vars = ovmf
+	vm.Firmware.Vars = ovmf
     }
 }
 
 func NewVM(name string) *VMConfig {
+    return newVM(name, SystemHost())
+}
+
+func newVM(name string, host *Host) *VMConfig {
     vm := &VMConfig{
-	name: name,
-	drives: []drive{},
-	nics: []nic{},
-	networks: []network{},
+	Name: name,
+	Drives: []Drive{},
+	NICs: []NIC{},
+	HostIP: hostip.Loopback(0),
+	Forwards: []Forward{},
+	Networks: []Network{},
 	// default settings
-	bootmenu: "menu=on,splash-time=5000",
-	vga: "std",
-	qemuexec: "qemu-system-x86_64",
+	BootMenu: "menu=on,splash-time=5000",
+	VGA: "std",
+	QemuExec: "qemu-system-x86_64",
+	Arch: host.Arch,
 	//
-	nsnw: newnsnw(),
-	virtfs: []virtfs{},
+	nsnw: newnsnw(host),
+	host: host,
+	Virtfs: []Virtfs{},
+	VirtiofsdExec: "virtiofsd",
+	PasstExec: "passt",
 	//
 	opts: map[string]string{},
 	//
-	hd0: drive{},
+	hds: map[int]Drive{},
 	// usb
-	usbhosts: []usbhost{},
-	usbdevs: []usb{},
+	USBHosts: []USBHost{},
+	USBDevices: []USBDevice{},
 	// serial
-	serial: "null",
+	Serial: "null",
     }
+    vm.Forwards, _ = ParseForwards(DefaultForwardList)
     return vm
 }
 
@@ -301,7 +394,9 @@ func (vm *VMConfig)addOption(opt string) {
     if val == "" {
 	return
     }
-    fmt.Printf("%s = %s\n", key, val)
+    if !vm.quiet {
+	fmt.Fprintf(os.Stderr, "%s = %s\n", key, val)
+    }
     if key[0] == '+' {
 	vm.opts[key[1:]] += " " + val
     } else {
@@ -309,265 +404,325 @@ func (vm *VMConfig)addOption(opt string) {
     }
 }
 
-func (vm *VMConfig)parseOptions() error {
-    hdX := make([]string, 10)
-    nicX := make([]string, 10)
-    usbX := make([]string, 10)
-    virtfsX := make([]string, 10)
-    for key, val := range vm.opts {
-	if len(key) > 2 && key[:2] == "hd" {
-	    // hdX
-	    n, _ := strconv.Atoi(key[2:])
-	    hdX[n] = val
+// Option returns the value of a config key as given,
+// for the keys others than qemu read like user and key
+func (vm *VMConfig)Option(key string) string {
+    return vm.opts[key]
+}
+
+// numbered option families, nic0, nic1 and so on
+var families = []string{ "hd", "nic", "usb", "virtiofs", "virtfs" }
+
+// maxInstance keeps the instance number in the last byte of MAC and local IP
+const maxInstance = 255
+
+// instance splits a numbered key like nic12 into its family and number
+func instance(key string) (string, int, bool, error) {
+    if key == "virtiofsd" {
+	return "", 0, false, nil
+    }
+    for _, family := range families {
+	if len(key) <= len(family) || key[:len(family)] != family {
 	    continue
 	}
-	if len(key) > 3 && key[:3] == "nic" {
-	    // nicX
-	    n, _ := strconv.Atoi(key[3:])
-	    nicX[n] = val
-	    fmt.Printf("nic%d %s\n", n, val)
-	    continue
+	idx := key[len(family):]
+	n, err := strconv.Atoi(idx)
+	if err != nil || idx[0] < '0' || idx[0] > '9' || n > maxInstance {
+	    return family, 0, true, fmt.Errorf("%s: bad index %q", key, idx)
 	}
-	if len(key) > 3 && key[:3] == "usb" {
-	    // usbX
-	    n, _ := strconv.Atoi(key[3:])
-	    usbX[n] = val
-	    fmt.Printf("usb%d %s\n", n, val)
-	    continue
+	return family, n, true, nil
+    }
+    return "", 0, false, nil
+}
+
+// instances is a family of numbered options by number
+type instances map[int]string
+
+// sorted returns the numbers in order
+func (x instances)sorted() []int {
+    idx := []int{}
+    for n := range x {
+	idx = append(idx, n)
+    }
+    sort.Ints(idx)
+    return idx
+}
+
+func (vm *VMConfig)parseOptions() error {
+    devs := map[string]instances{}
+    hostipval := ""
+    for _, family := range families {
+	devs[family] = instances{}
+    }
+    for key, val := range vm.opts {
+	// virtfs and virtiofs are the first ones
+	switch key {
+	case "virtfs": key = "virtfs0"
+	case "virtiofs": key = "virtiofs0"
 	}
-	if len(key) > 6 && key[:6] == "virtfs" {
-	    n, _ := strconv.Atoi(key[6:])
-	    virtfsX[n] = val
-	    fmt.Printf("virtfs%d %s\n", n, val)
+	family, n, ok, err := instance(key)
+	if err != nil {
+	    return err
+	}
+	if ok {
+	    if _, dup := devs[family][n]; dup {
+		return fmt.Errorf("%s%d: given twice", family, n)
+	    }
+	    devs[family][n] = val
+	    if family != "hd" {
+		fmt.Fprintf(os.Stderr, "%s%d %s\n", family, n, val)
+	    }
 	    continue
 	}
 	switch key {
-	case "name": vm.name = val
-	case "id": vm.id, _ = strconv.Atoi(val)
-	case "cpu": vm.cpu = val
-	case "smp": vm.smp = val
-	case "mem": vm.mem = val
-	case "vga": vm.vga = val
-	case "serial": vm.serial = val
-	case "sound": vm.sound = val
-	case "qemu": vm.qemuexec = val
-	case "localtime": if val != "0" { vm.localtime = true }
-	case "noshut": if val != "0" { vm.noreboot = true }
-	case "defaults": if val != "0" { vm.defaults = true }
-	case "cdrom": vm.drives = append(vm.drives, drive{ path: val, intf: "ide", media: "cdrom"})
-	case "virtfs": virtfsX[0] = val
-	case "kernel": vm.kernel = val
-	case "initrd": vm.initrd = val
-	case "append": vm.cmdline = val
+	case "name": vm.Name = val
+	case "id": vm.ID, _ = strconv.Atoi(val)
+	case "cpu": vm.CPU = val
+	case "smp": vm.SMP = val
+	case "mem":
+	    if err := vm.parseMem(val); err != nil {
+		return err
+	    }
+	case "vga": vm.VGA = val
+	case "serial": vm.Serial = val
+	case "sound": vm.Sound = val
+	case "qemu": vm.QemuExec = val
+	case "arch": vm.Arch = val
+	case "machine": vm.Machine = val
+	case "accel": vm.Accel = val
+	case "localtime": if val != "0" { vm.Localtime = true }
+	case "noshut": if val != "0" { vm.NoReboot = true }
+	case "defaults": if val != "0" { vm.Defaults = true }
+	case "guestagent": if val != "0" { vm.GuestAgent = true }
+	case "cgroup": vm.Resources.Parent = val
+	case "cpu.weight": vm.Resources.CPUWeight = val
+	case "cpu.max": vm.Resources.CPUMax = val
+	case "memory.max": vm.Resources.MemoryMax = val
+	case "memory.high": vm.Resources.MemoryHigh = val
+	case "io.weight": vm.Resources.IOWeight = val
+	case "cpupin":
+	    pins, err := parseCPUPin(val)
+	    if err != nil {
+		return err
+	    }
+	    vm.CPUPin = pins
+	case "numa":
+	    nodes, err := parseNUMA(val)
+	    if err != nil {
+		return err
+	    }
+	    vm.NUMA = nodes
+	case "hostip": hostipval = val
+	case "vnc": vm.VNC = val
+	case "forwards":
+	    fwds, err := ParseForwards(val)
+	    if err != nil {
+		return err
+	    }
+	    vm.Forwards = fwds
+	case "cdrom": vm.AddDrive(Drive{ Path: val, Interface: "ide", Media: "cdrom" })
+	case "virtiofsd": vm.VirtiofsdExec = val
+	case "passt": vm.PasstExec = val
+	case "kernel": vm.Kernel = val
+	case "initrd": vm.Initrd = val
+	case "append": vm.Cmdline = val
 	}
     }
-    if vm.smp != "" {
-	params := strings.Split(vm.smp, ",")
+    if err := vm.setupArch(); err != nil {
+	return err
+    }
+    scheme, err := hostip.Parse(hostipval, vm.ID)
+    if err != nil {
+	return err
+    }
+    vm.HostIP = scheme
+    if scheme.Mode == "loopback" && vm.ID == 0 {
+	fmt.Fprintf(os.Stderr, "id 0 listens on 127.0.0.0, use hostip = offset or bind\n")
+    }
+    if vm.Mem == "" && len(vm.NUMA) > 0 {
+	// -m is the sum of the nodes
+	total := uint64(0)
+	for _, node := range vm.NUMA {
+	    size, err := parseSize(node.Mem)
+	    if err != nil {
+		return fmt.Errorf("numa: %v", err)
+	    }
+	    total += size
+	}
+	vm.Mem = fmt.Sprintf("%dM", total >> 20)
+    }
+    if vm.SMP != "" {
+	params := strings.Split(vm.SMP, ",")
 	if len(params) == 1 {
 	    // single socket multiple cores
-	    smp := vm.smp
-	    vm.smp = fmt.Sprintf("%s,sockets=1,cores=%s", smp, smp)
+	    smp := vm.SMP
+	    vm.SMP = fmt.Sprintf("%s,sockets=1,cores=%s", smp, smp)
 	}
     }
-    // TODO hdX
-    // check only hd0
-    if hdX[0] != "" {
-	vm.hd0 = drive{}
-	params := strings.Split(hdX[0], " ")
-	for _, param := range params {
-	    if param[:3] == "if=" {
-		vm.hd0.intf = param[3:]
-		continue
-	    }
-	    if param[:5] == "path=" {
-		vm.hd0.path = param[5:]
-		continue
-	    }
-	    if param[:7] == "format=" {
-		vm.hd0.format = param[7:]
-		continue
+    // hdX
+    for _, i := range devs["hd"].sorted() {
+	hd := Drive{}
+	for _, param := range strings.Fields(devs["hd"][i]) {
+	    key, val := keyval(param)
+	    switch key {
+	    case "if": hd.Interface = val
+	    case "path": hd.Path = val
+	    case "format": hd.Format = val
+	    default:
+		return fmt.Errorf("hd%d: unknown %q", i, param)
 	    }
 	}
+	vm.hds[i] = hd
     }
     // nicX
-    vm.nics = []nic{}
-    vm.networks = []network{}
-    for i := 0; i < 10; i++ {
-	if nicX[i] == "" {
-	    continue
-	}
-	netdev := fmt.Sprintf("vnic%d", i)
-	nic := nic{ driver: "virtio-net", netdev: netdev }
-	net := network{ nettype: "user", netdev: netdev }
-	nic.mac = fmt.Sprintf("52:54:00:%02x:%02x:%02x", vm.id / 256, vm.id % 256, i)
-	params := strings.Split(nicX[i], " ")
-	for _, param := range params {
+    vm.NICs = []NIC{}
+    vm.Networks = []Network{}
+    for _, i := range devs["nic"].sorted() {
+	nic, net := vm.NewNIC(i)
+	for _, param := range strings.Fields(devs["nic"][i]) {
 	    if param == "default" {
-		nic.driver = "virtio-net"
-		net.nettype = "user"
-		lo := vm.localIP(i)
-		net.hostfwds = []string{
-		    fmt.Sprintf("tcp:%s:10022-:22", lo),
-		    fmt.Sprintf("tcp:%s:10080-:80", lo),
-		    fmt.Sprintf("tcp:%s:13389-:3389", lo),
-		}
+		nic.Driver = "virtio-net"
+		net.Type = "user"
+		net.HostFwds = vm.DefaultForwards(i)
 		continue
 	    }
-	    if param[:7] == "socket=" {
-		net.nettype = "socket"
-		net.localIP = vm.localIP(i)
-		// TODO: post script
+	    if param == "passt" {
+		// the default forwards through passt
+		net.Type = "passt"
+		net.Socket = passtSocket(net.Netdev)
+		net.HostFwds = vm.DefaultForwards(i)
 		continue
 	    }
-	    if param[:4] == "tap=" {
-		net.nettype = "tap"
-		net.ifname = param[4:]
+	    if strings.HasPrefix(param, "socket=") {
+		// the switch connects to us after launch
+		net.Type = "socket"
+		net.LocalIP = vm.localIP(i)
+		net.LocalPort = vm.hostIP().Port(i, SocketPort)
+		net.Switch = param[7:]
 		continue
 	    }
-	    if param[:5] == "nsnw=" {
-		net.nettype = "tap"
-		net.nsnwtap = fmt.Sprintf("tap%s%d", vm.name, i)
+	    if strings.HasPrefix(param, "tap=") {
+		net.Type = "tap"
+		net.Ifname = param[4:]
+		continue
+	    }
+	    if strings.HasPrefix(param, "nsnw=") {
+		net.Type = "tap"
+		ns := &NSNWLink{}
+		ns.Tap = fmt.Sprintf("tap%s%d", vm.Name, i)
 		// check env
-		key := fmt.Sprintf("NSTAPFD_%s", net.nsnwtap)
-		val, ok := os.LookupEnv(key)
+		key := fmt.Sprintf("NSTAPFD_%s", ns.Tap)
+		val, ok := vm.host.LookupEnv(key)
 		if ok {
-		    net.nsnwtapfd = val
-		    fmt.Printf("%s=%s\n", net.nsnwtap, net.nsnwtapfd)
+		    ns.TapFD = val
+		    fmt.Fprintf(os.Stderr, "%s=%s\n", ns.Tap, ns.TapFD)
 		}
-		net.nsnwopt = param[5:]
-		opts := strings.Split(net.nsnwopt, ",")
+		opts := strings.Split(param[5:], ",")
 		for _, kv := range opts {
 		    key, val := keyval(kv)
 		    switch key {
-		    case "name": net.nsnwname = val
-		    case "path": net.nsnwpath = val
-		    case "br": net.nsnwbr = val
+		    case "name": ns.Name = val
+		    case "path": ns.Path = val
+		    case "br": ns.Bridge = val
 		    }
 		}
 		// get pid and tap
-		if net.nsnwpath != "" {
-		    net.nsnwpid = vm.nsnw.getpid(net.nsnwpath)
+		if ns.Path != "" {
+		    ns.Pid = vm.nsnw.getpid(ns.Path)
 		} else {
-		    if net.nsnwname == "" {
+		    if ns.Name == "" {
 			return fmt.Errorf("nsnw: bad opt");
 		    }
-		    nsnw := proc.GetNSNW(net.nsnwname)
-		    if nsnw == nil {
-			return fmt.Errorf("nsnw: no nsnw name=%s", net.nsnwname);
+		    pid, ok := vm.host.NSNWPid(ns.Name)
+		    if !ok {
+			return fmt.Errorf("nsnw: no nsnw name=%s", ns.Name);
 		    }
-		    net.nsnwpid = fmt.Sprintf("%d", nsnw.Pid)
+		    ns.Pid = fmt.Sprintf("%d", pid)
 		}
-		fmt.Printf("nsnw pid=%s tapname=%s\n", net.nsnwpid, net.nsnwtap)
+		net.NSNW = ns
+		fmt.Fprintf(os.Stderr, "nsnw pid=%s tapname=%s\n", ns.Pid, ns.Tap)
 		continue
 	    }
-	    if param[:4] == "mac=" {
+	    if strings.HasPrefix(param, "mac=") {
 		mac := param[4:]
 		if mac != "auto" {
-		    nic.mac = mac
+		    nic.MAC = mac
 		}
 		continue
 	    }
-	    if param[:6] == "proxy=" {
-		net.proxy = param[6:]
+	    if strings.HasPrefix(param, "proxy=") {
+		net.Proxy = param[6:]
 		continue
 	    }
-	    if param[:7] == "driver=" {
-		nic.driver = param[7:]
+	    if strings.HasPrefix(param, "driver=") {
+		nic.Driver = param[7:]
 		continue
 	    }
-	    if param[:8] == "hostfwd=" {
-		p := strings.Replace(param[8:], "$ip", vm.localIP(i), -1)
-		net.hostfwds = append(net.hostfwds, p)
+	    if strings.HasPrefix(param, "hostfwd=") {
+		p := vm.hostIP().Expand(param[8:], i)
+		net.HostFwds = append(net.HostFwds, p)
 		continue
 	    }
-	    if param[:9] == "restrict=" {
-		net.restrict = param[9:]
+	    if strings.HasPrefix(param, "restrict=") {
+		net.Restrict = param[9:]
 		continue
 	    }
-	    if param[:9] == "guestfwd=" {
-		net.guestfwds = append(net.guestfwds, param[9:])
+	    if strings.HasPrefix(param, "guestfwd=") {
+		net.GuestFwds = append(net.GuestFwds, param[9:])
 		continue
 	    }
+	    return fmt.Errorf("nic%d: unknown %q", i, param)
 	}
-	vm.nics = append(vm.nics, nic)
-	vm.networks = append(vm.networks, net)
+	vm.AddNetwork(nic, net)
     }
     // usbX
-    for i := 0; i < 10; i++ {
-	if usbX[i] == "" {
-	    continue
-	}
-	usbdev := usb{}
+    for _, i := range devs["usb"].sorted() {
+	usbdev := USBDevice{}
 	// usb0 = storage=path bus=xhci
-	params := strings.Split(usbX[i], " ")
-	for _, param := range params {
-	    if param[:8] == "storage=" {
+	for _, param := range strings.Fields(devs["usb"][i]) {
+	    if strings.HasPrefix(param, "storage=") {
 		path := param[8:]
-		a := strings.Split(path, ".")
 		format := "raw"
-		if a[1] == "qcow2" {
+		if filepath.Ext(path) == ".qcow2" {
 		    format = "qcow2"
 		}
 		id := fmt.Sprintf("usbstorage%d", i)
 		// create drive
-		storage := drive{
-		    intf: "none",
-		    id: id,
-		    path: path,
-		    format: format,
+		storage := Drive{
+		    Interface: "none",
+		    ID: id,
+		    Path: path,
+		    Format: format,
 		}
-		vm.drives = append(vm.drives, storage)
-		usbdev.device = "storage"
-		usbdev.drive = id
+		vm.AddDrive(storage)
+		usbdev.Device = "storage"
+		usbdev.Drive = id
 		continue
 	    }
-	    if param[:4] == "bus=" {
-		bus := param[4:]
-		ok := false
-		// lookup hosts
-		for _, usbhost := range vm.usbhosts {
-		    if usbhost.id == bus {
-			ok = true
-			break
-		    }
-		}
-		if !ok {
-		    vm.usbhosts = append(vm.usbhosts, usbhost{ id: bus })
-		}
-		usbdev.bus = bus
+	    if strings.HasPrefix(param, "bus=") {
+		usbdev.Bus = param[4:]
+		vm.AddUSBHost(usbdev.Bus)
 		continue
 	    }
+	    return fmt.Errorf("usb%d: unknown %q", i, param)
 	}
-	vm.usbdevs = append(vm.usbdevs, usbdev)
+	vm.AddUSBDevice(usbdev)
     }
-    // virtfsA
-    for i := 0; i < 10; i++ {
-	if virtfsX[i] == "" {
-	    continue
-	}
-	v := virtfs{
-	    driver: "local",
-	    id: fmt.Sprintf("virtfs%d", i),
-	    path: virtfsX[i],
-	    mount_tag: "ground",
-	    security_model: "none",
-	    readonly: false,
+    // virtfsX
+    for _, i := range devs["virtfs"].sorted() {
+	v, err := parseVirtfs(i, devs["virtfs"][i])
+	if err != nil {
+	    return err
 	}
-	if i > 0 {
-	    v.mount_tag = fmt.Sprintf("ground%d", i)
-	}
-	vals := strings.Split(virtfsX[i], " ")
-	for _, val := range vals {
-	    if len(val) > 4 && val[:4] == "tag=" {
-		v.mount_tag = val[4:]
-		continue
-	    }
-	    switch val {
-	    case "readonly": v.readonly = true
-	    default: v.path = val
-	    }
+	vm.AddVirtfs(v)
+    }
+    // virtiofsX
+    for _, i := range devs["virtiofs"].sorted() {
+	fs, err := parseVirtiofs(i, devs["virtiofs"][i])
+	if err != nil {
+	    return err
 	}
-	vm.virtfs = append(vm.virtfs, v)
+	vm.AddVirtiofs(fs)
     }
     return nil
 }
@@ -577,13 +732,60 @@ func FromConfig(dir, path string, opts []string) (*VMConfig, error) {
     if err != nil {
 	return nil, fmt.Errorf("FromConfig: %v", err)
     }
-    vm := NewVM("new")
-    vm.dir = dir
-    // default network option
-    vm.addOption("nic0=default")
-    //
+    defer f.Close()
     data, err := ioutil.ReadAll(f)
-    lines := strings.Split(string(data), "\n")
+    if err != nil {
+	return nil, fmt.Errorf("FromConfig: %v", err)
+    }
+    return FromText(dir, string(data), opts, SystemHost())
+}
+
+// Options reads the config at path with the user defaults and opts like
+// FromConfig but only into the key values, nothing is checked or built
+func Options(path string, opts []string) (map[string]string, error) {
+    data, err := ioutil.ReadFile(path)
+    if err != nil {
+	return nil, fmt.Errorf("Options: %v", err)
+    }
+    return optionsFromText(string(data), opts, SystemHost()), nil
+}
+
+func optionsFromText(config string, opts []string, host *Host) map[string]string {
+    vm := newVM("new", host)
+    vm.quiet = true
+    vm.addLines(vm.userDefaults())
+    vm.addLines(config)
+    for _, opt := range opts {
+	vm.addOption(opt)
+    }
+    return vm.opts
+}
+
+// DefaultsFile is the user wide config read before each VM config
+const DefaultsFile = "vm/defaults"
+
+// userDefaults reads $XDG_CONFIG_HOME/vm/defaults or ~/.config/vm/defaults
+func (vm *VMConfig)userDefaults() string {
+    path := ""
+    if dir, ok := vm.host.LookupEnv("XDG_CONFIG_HOME"); ok && dir != "" {
+	path = filepath.Join(dir, DefaultsFile)
+    } else if home, ok := vm.host.LookupEnv("HOME"); ok && home != "" {
+	path = filepath.Join(home, ".config", DefaultsFile)
+    } else {
+	return ""
+    }
+    data, err := vm.host.ReadFile(path)
+    if err != nil {
+	return ""
+    }
+    if !vm.quiet {
+	fmt.Fprintf(os.Stderr, "defaults from %s\n", path)
+    }
+    return string(data)
+}
+
+func (vm *VMConfig)addLines(config string) {
+    lines := strings.Split(config, "\n")
     for _, line := range lines {
 	if line == "" {
 	    continue
@@ -593,14 +795,30 @@ func FromConfig(dir, path string, opts []string) (*VMConfig, error) {
 	}
 	vm.addOption(line)
     }
+}
+
+// FromText builds the VM from config text, everything about the host
+// comes from host so the result depends only on the arguments
+func FromText(dir, config string, opts []string, host *Host) (*VMConfig, error) {
+    vm := newVM("new", host)
+    vm.Dir = dir
+    // default network option
+    vm.addOption("nic0=default")
+    // user defaults then the config
+    vm.addLines(vm.userDefaults())
+    vm.addLines(config)
     // override
     for _, opt := range opts {
 	vm.addOption(opt)
     }
     if err := vm.parseOptions(); err != nil {
-	fmt.Printf("parse error: %v\n", err)
+	fmt.Fprintf(os.Stderr, "parse error: %v\n", err)
 	return nil, err
     }
     vm.localSetup()
+    if err := vm.Validate(); err != nil {
+	fmt.Fprintf(os.Stderr, "%v\n", err)
+	return nil, err
+    }
     return vm, nil
 }
@@ -0,0 +1,715 @@
+// vm/qemu / qemu_test.go
+//
+// MIT License Copyright(c) 2021 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+//
+package qemu
+
+import (
+    "encoding/json"
+    "flag"
+    "fmt"
+    "io/ioutil"
+    "os"
+    "os/exec"
+    "path/filepath"
+    "reflect"
+    "strings"
+    "testing"
+    "time"
+)
+
+var update = flag.Bool("update", false, "update golden files")
+
+type fakeHost struct {
+    files []string
+    env map[string]string
+    nsnws map[string]int
+    pidfiles map[string]string
+    // dirs that do not exist, everything else is a directory
+    missing []string
+    nokvm bool
+    // arch is x86_64 unless given
+    arch string
+}
+
+type fakeDir string
+
+func (d fakeDir)Name() string { return filepath.Base(string(d)) }
+func (d fakeDir)Size() int64 { return 0 }
+func (d fakeDir)Mode() os.FileMode { return os.ModeDir | 0755 }
+func (d fakeDir)ModTime() time.Time { return time.Time{} }
+func (d fakeDir)IsDir() bool { return true }
+func (d fakeDir)Sys() interface{} { return nil }
+
+func (f *fakeHost)host() *Host {
+    arch := f.arch
+    if arch == "" {
+	arch = "x86_64"
+    }
+    return &Host{
+	Files: func(dir string) []string {
+	    return f.files
+	},
+	LookupEnv: func(key string) (string, bool) {
+	    val, ok := f.env[key]
+	    return val, ok
+	},
+	NSNWPid: func(name string) (int, bool) {
+	    pid, ok := f.nsnws[name]
+	    return pid, ok
+	},
+	ReadFile: func(path string) ([]byte, error) {
+	    data, ok := f.pidfiles[path]
+	    if !ok {
+		return nil, fmt.Errorf("no file %s", path)
+	    }
+	    return []byte(data), nil
+	},
+	Stat: func(path string) (os.FileInfo, error) {
+	    for _, m := range f.missing {
+		if m == path {
+		    return nil, fmt.Errorf("stat %s: no such file or directory", path)
+		}
+	    }
+	    return fakeDir(path), nil
+	},
+	Arch: arch,
+	KVM: func() bool {
+	    return !f.nokvm
+	},
+    }
+}
+
+var builderTests = []struct {
+    name string
+    config string
+    opts []string
+    host fakeHost
+}{
+    {
+	name: "minimal",
+	config: "name = minimal\nid = 1\n",
+    },
+    {
+	name: "disks",
+	config: "# local disks and firmware\nname = disks\nid = 258\ncdrom = install.iso\n",
+	host: fakeHost{
+	    files: []string{ "hd0.qcow2", "hd1.raw", "OVMF_CODE.fd", "OVMF_VARS.fd", "notes.txt" },
+	},
+    },
+    {
+	name: "hd0override",
+	config: "name = hd0\nid = 2\nhd0 = if=ide path=/images/base.raw format=raw\n",
+	host: fakeHost{
+	    files: []string{ "hd0.qcow2", "OVMF.fd" },
+	},
+    },
+    {
+	name: "overrides",
+	config: "name = kernel\nid = 3\nmem = 1G\nsmp = 2\nkernel = vmlinuz\ninitrd = initrd.img\nappend = console=ttyS0\n",
+	opts: []string{ "mem=4G", "+append=quiet", "localtime=1", "noshut=1", "defaults=1" },
+    },
+    {
+	name: "resources",
+	config: "name = res\nid = 11\ncpu.weight = 50\nmemory.max = 4G\nio.weight = 200\n",
+    },
+    {
+	name: "nics",
+	config: "name = nics\nid = 4\n" +
+	    "nic1 = tap=tap0000 mac=52:54:00:11:22:33 driver=e1000\n" +
+	    "nic2 = socket=sw0\n" +
+	    "nic3 = nsnw=name=lab,br=br0\n" +
+	    "nic4 = nsnw=path=/run/nsnw.pid,br=br1\n" +
+	    "nic5 = restrict=on hostfwd=tcp:$ip:8080-:80 guestfwd=tcp:10.0.2.100:80-cmd:nc+host+80\n",
+	host: fakeHost{
+	    env: map[string]string{ "NSTAPFD_tapnics3": "5" },
+	    nsnws: map[string]int{ "lab": 1234 },
+	    pidfiles: map[string]string{ "/run/nsnw.pid": "4321" },
+	},
+    },
+    {
+	name: "q35",
+	config: "name = q35\nid = 6\nmachine = q35\nguestagent = 1\n",
+    },
+    {
+	name: "nokvm",
+	config: "name = nokvm\nid = 7\naccel = kvm\n",
+	host: fakeHost{ nokvm: true },
+    },
+    {
+	name: "aarch64",
+	config: "name = arm\nid = 8\narch = aarch64\n",
+	host: fakeHost{ files: []string{ "AAVMF_CODE.fd", "AAVMF_VARS.fd" } },
+    },
+    {
+	name: "riscv64",
+	config: "name = riscv\nid = 9\narch = riscv64\nkernel = fw_jump.elf\n",
+    },
+    {
+	name: "ppc64le",
+	config: "name = ppc\nid = 10\narch = ppc64le\naccel = tcg\nqemu = /opt/qemu/bin/qemu-system-ppc64\n",
+    },
+    {
+	name: "numa",
+	config: "name = numa\nid = 12\nsmp = 4\ncpupin = 2-5\nnuma = cpus=0-1,mem=1G,host=0 cpus=2-3,mem=1024M,host=1\n",
+    },
+    {
+	name: "hugepages",
+	config: "name = huge\nid = 13\nmem = 4G hugepages prealloc share=on balloon\n",
+    },
+    {
+	name: "numashare",
+	config: "name = numashare\nid = 14\nmem = share\nnuma = cpus=0,mem=512M cpus=1,mem=512M\n",
+    },
+    {
+	name: "virtiofs",
+	config: "name = virtiofs\nid = 15\nmem = 2G\n" +
+	    "virtiofs = /srv/build\n" +
+	    "virtiofs1 = /srv/ro tag=ro readonly\n" +
+	    "virtiofsd = /usr/libexec/virtiofsd --sandbox=none\n",
+    },
+    {
+	name: "usbvirtfs",
+	config: "name = usb\nid = 5\n" +
+	    "usb0 = storage=stick.qcow2 bus=xhci\n" +
+	    "usb1 = storage=disk.img bus=xhci\n" +
+	    "virtfs = /srv/share\n" +
+	    "virtfs1 = /srv/ro tag=ro readonly\n",
+    },
+    {
+	name: "many",
+	config: "name = many\nid = 17\n" +
+	    "nic2 = tap=tap2\nnic10 = tap=tap10\nnic255 = socket=sw0\n" +
+	    "hd12 = path=/images/data.raw format=raw\n" +
+	    "virtfs = /srv/a\nvirtfs11 = /srv/b\nvirtfs3 = /srv/c\n",
+	host: fakeHost{
+	    files: []string{ "hd0.qcow2", "hd3.qcow2", "hd12.qcow2" },
+	},
+    },
+    {
+	name: "forwards",
+	config: "name = fwd\nid = 18\nforwards = 2222-22 udp:5353-53,8080-10.0.2.15:80 127.0.0.1:9000-9000\n",
+    },
+    {
+	name: "userdefaults",
+	config: "name = defaults\nid = 19\nsmp = 4\n",
+	host: fakeHost{
+	    env: map[string]string{ "HOME": "/home/user" },
+	    pidfiles: map[string]string{
+		"/home/user/.config/vm/defaults": "# everywhere\nsmp = 2\nmem = 2G\nforwards = 10022-22 tcp:15900-5900\n",
+	    },
+	},
+    },
+    {
+	name: "hostipoffset",
+	config: "name = offset\nid = 20\nhostip = offset\nnic1 = default\n",
+    },
+    {
+	name: "hostipbind",
+	config: "name = bind\nid = 0\nhostip = bind 192.168.1.10\nvnc = unix\nnic1 = hostfwd=tcp:$ip:8080-:80\n",
+    },
+    {
+	name: "passt",
+	config: "name = passt\nid = 21\nnic0 = passt\n" +
+	    "nic1 = passt hostfwd=udp:$ip:5353-:53 hostfwd=tcp::8080-:80\n" +
+	    "passt = /usr/local/bin/passt --quiet\n",
+    },
+    {
+	name: "virtfsopts",
+	config: "name = virtfs\nid = 16\n" +
+	    "virtfs0 = path=/srv/data tag=data security_model=mapped-xattr fmode=0640 dmode=0750 multidevs=remap\n" +
+	    "virtfs1 = /srv/pass security_model=passthrough multidevs=forbid\n" +
+	    "virtfs2 = /srv/file tag=file security_model=mapped-file readonly\n",
+    },
+}
+
+func render(vm *VMConfig) string {
+    cmd := vm.Qemu()
+    lines := []string{ "args:" }
+    lines = append(lines, cmd.Args...)
+    lines = append(lines, "env:")
+    lines = append(lines, vm.Env()...)
+    if helpers := vm.Helpers(); len(helpers) > 0 {
+	lines = append(lines, "helpers:")
+	for _, h := range helpers {
+	    lines = append(lines, ShellQuote(h.Command()))
+	}
+    }
+    return strings.Join(lines, "\n") + "\n"
+}
+
+func checkGolden(t *testing.T, name, got string) {
+    golden := filepath.Join("testdata", name + ".golden")
+    if *update {
+	if err := ioutil.WriteFile(golden, []byte(got), 0644); err != nil {
+	    t.Fatal(err)
+	}
+    }
+    want, err := ioutil.ReadFile(golden)
+    if err != nil {
+	t.Fatal(err)
+    }
+    if got != string(want) {
+	t.Errorf("mismatch with %s\ngot:\n%s\nwant:\n%s", golden, got, want)
+    }
+}
+
+func TestBuilder(t *testing.T) {
+    for _, tt := range builderTests {
+	t.Run(tt.name, func(t *testing.T) {
+	    vm, err := FromText("/vm/" + tt.name, tt.config, tt.opts, tt.host.host())
+	    if err != nil {
+		t.Fatalf("FromText: %v", err)
+	    }
+	    checkGolden(t, tt.name, render(vm))
+	})
+    }
+}
+
+func TestParseOptionsErrors(t *testing.T) {
+    tests := []struct {
+	config string
+	err string
+    }{
+	{ "nic0 = nsnw=br=br0\n", "nsnw: bad opt" },
+	{ "nic0 = nsnw=name=missing\n", "nsnw: no nsnw name=missing" },
+	{ "arch = mips\n", "arch: unknown mips" },
+	{ "arch = aarch64\nmachine = q35\n", "arch: machine q35 is not for aarch64" },
+	{ "machine = pcx\n", "arch: machine pcx is not for x86_64" },
+	{ "machine = q35foo\n", "arch: machine q35foo is not for x86_64" },
+	{ "accel = hvf\n", "arch: unknown accel hvf" },
+	{ "cpu.weight = 0\n", "validate: cpu.weight \"0\" not in 1-10000" },
+	{ "cpu.max = 50%\n", "validate: cpu.max \"50%\"" },
+	{ "mem = 4G\nnuma = cpus=0,mem=1G cpus=1,mem=1G\n", "validate: mem 4G does not match numa nodes" },
+	{ "numa = cpus=0\n", "numa: node needs cpus and mem \"cpus=0\"" },
+	{ "cpupin = 0:a\n", "cpupin: bad cpu list \"a\"" },
+	{ "mem = 4G hugepage=/dev/hugepages\n", "mem: unknown hugepage=/dev/hugepages" },
+	{ "mem = prealloc\n", "validate: memory backend without mem size" },
+	{ "virtiofs0 = /srv\n", "validate: memory backend without mem size" },
+	{ "hdx = path=/images/x.raw\n", "hdx: bad index \"x\"" },
+	{ "nic256 = default\n", "nic256: bad index \"256\"" },
+	{ "nic+1 = default\n", "nic+1: bad index \"+1\"" },
+	{ "usb-1 = bus=xhci\n", "usb-1: bad index \"-1\"" },
+	{ "virtfs = /srv\nvirtfs0 = /home\n", "virtfs0: given twice" },
+	{ "nic1 = user\n", "nic1: unknown \"user\"" },
+	{ "usb0 = stick.img\n", "usb0: unknown \"stick.img\"" },
+	{ "hd0 = /images/x.raw\n", "hd0: unknown \"/images/x.raw\"" },
+	{ "forwards = 10022\n", "forward: bad \"10022\"" },
+	{ "forwards = 10022-ssh\n", "forward: \"10022-ssh\" bad port \"ssh\"" },
+	{ "forwards = 10022-22 tcp:10022-2222\n", "forward: 10022-22 and tcp:10022-2222 use the same host port" },
+	{ "hostip = bind\n", "hostip: unknown \"bind\"" },
+	{ "hostip = offset localhost\n", "hostip: bad address localhost" },
+	{ "id = 5300\nhostip = offset\n", "validate: vnic0 forward: \"tcp:127.0.0.1:66389-:3389\" bad port \"66389\"" },
+	{ "hostip = offset\nnic10 = default\n", "validate: vnic10 is beyond nic9 of hostip = offset" },
+	{ "id = 60000\nhostip = bind 127.0.0.1\n", "validate: vnc port 65900 out of range" },
+	{ "vnc = sdl\n", "validate: unknown vnc sdl" },
+	{ "nic1 = socket=sw0,sw1\n", "validate: vnic1 bad switch name sw0,sw1" },
+	{ "nic0 = passt hostfwd=tcp::8080-10.0.2.15:80\n", "validate: vnic0 passt forwards to the guest address only \"tcp::8080-10.0.2.15:80\"" },
+	{ "virtfs0 = /srv rw\n", "virtfs0: unknown \"rw\", path is /srv" },
+	{ "virtfs0 = /srv security=none\n", "virtfs0: unknown \"security=none\"" },
+	{ "virtfs0 = readonly\n", "virtfs0: no path" },
+	{ "virtfs0 = /srv security_model=mapped-xattrs\n", "validate: virtfs0 unknown security_model mapped-xattrs" },
+	{ "virtfs0 = /srv multidevs=ignore\n", "validate: virtfs0 unknown multidevs ignore" },
+	{ "virtfs0 = /srv fmode=0644\n", "validate: virtfs0 fmode and dmode need a mapped security_model" },
+	{ "virtfs0 = /srv security_model=mapped dmode=0799\n", "validate: virtfs0 bad mode 0799" },
+	{ "virtfs0 = /srv\nvirtfs1 = /home tag=ground\n", "validate: virtfs0 and virtfs1 use the same tag ground" },
+	{ "mem = 1G\nvirtfs0 = /srv tag=share\nvirtiofs0 = /home tag=share\n", "validate: virtfs0 and virtiofs0 use the same tag share" },
+	{ "mem = 1G\nvirtiofs0 = /srv cache=none\n", "virtiofs0: unknown \"cache=none\"" },
+    }
+    for _, tt := range tests {
+	_, err := FromText("/vm/err", tt.config, nil, (&fakeHost{}).host())
+	if err == nil || err.Error() != tt.err {
+	    t.Errorf("%q: got error %v, want %s", tt.config, err, tt.err)
+	}
+    }
+}
+
+func TestLocalSetup(t *testing.T) {
+    tests := []struct {
+	files []string
+	code, vars string
+	drives []string
+    }{
+	{ []string{}, "", "", []string{} },
+	{ []string{ "OVMF.fd" }, "", "OVMF.fd", []string{} },
+	{ []string{ "OVMF_CODE.fd", "OVMF_VARS.fd", "OVMF.fd" }, "OVMF_CODE.fd", "OVMF_VARS.fd", []string{} },
+	{ []string{ "OVMF_CODE.fd", "OVMF.fd" }, "", "OVMF.fd", []string{} },
+	{ []string{ "hd1.raw", "hd0.qcow2", "hd0.qcow2.bak", "hdx.raw" }, "", "",
+	    []string{ "file=hd0.qcow2,format=qcow2,if=virtio", "file=hd1.raw,format=raw,if=virtio" } },
+	{ []string{ "hd10.qcow2", "hd2.raw", "hd256.raw" }, "", "",
+	    []string{ "file=hd2.raw,format=raw,if=virtio", "file=hd10.qcow2,format=qcow2,if=virtio" } },
+    }
+    for _, tt := range tests {
+	vm := newVM("local", (&fakeHost{ files: tt.files }).host())
+	vm.localSetup()
+	if vm.Firmware.Code != tt.code || vm.Firmware.Vars != tt.vars {
+	    t.Errorf("%v: ovmf %q %q, want %q %q", tt.files, vm.Firmware.Code, vm.Firmware.Vars, tt.code, tt.vars)
+	}
+	drives := []string{}
+	for _, d := range vm.Drives {
+	    drives = append(drives, d.value())
+	}
+	if strings.Join(drives, " ") != strings.Join(tt.drives, " ") {
+	    t.Errorf("%v: drives %v, want %v", tt.files, drives, tt.drives)
+	}
+    }
+}
+
+func TestHostForwards(t *testing.T) {
+    args := []string{
+	"qemu-system-x86_64", "-name", "fwd",
+	"-netdev", "user,id=vnic0,hostfwd=tcp:127.0.18.0:10022-:22,hostfwd=udp::5353-10.0.2.15:53",
+	"-netdev", "tap,id=vnic1,ifname=tap1",
+	"-netdev", "user,id=vnic10,hostfwd=tcp:127.0.18.10:8080-:80,restrict=on",
+	"-netdev", "user,id=vnic2,hostfwd=tcp:127.0.18.2:8080-:80",
+    }
+    fwds := HostForwards(args)
+    got := []string{}
+    for _, netdev := range Netdevs(fwds) {
+	for _, f := range fwds[netdev] {
+	    got = append(got, netdev + "=" + f.String())
+	}
+    }
+    want := "vnic0=tcp:127.0.18.0:10022-:22 vnic0=udp::5353-10.0.2.15:53 vnic2=tcp:127.0.18.2:8080-:80 vnic10=tcp:127.0.18.10:8080-:80"
+    if strings.Join(got, " ") != want {
+	t.Errorf("got %v, want %s", got, want)
+    }
+}
+
+func TestPasstForwards(t *testing.T) {
+    fwds := []string{ "tcp:127.0.21.0:10022-:22", "udp::5353-:53" }
+    ports, err := passtPorts(fwds)
+    if err != nil {
+	t.Fatal(err)
+    }
+    if got := strings.Join(ports, " "); got != "-t 127.0.21.0/10022:22 -u 5353:53" {
+	t.Errorf("ports %s", got)
+    }
+    args := append([]string{ "passt", "--foreground", "--socket", "passt0.sock" }, ports...)
+    got := []string{}
+    for _, f := range PasstForwards(args) {
+	got = append(got, f.String())
+    }
+    if strings.Join(got, " ") != strings.Join(fwds, " ") {
+	t.Errorf("forwards %v, want %v", got, fwds)
+    }
+}
+
+func TestSwitchPorts(t *testing.T) {
+    config := "name = plug\nid = 22\nhostip = offset\nnic1 = socket=lab\nnic2 = socket=\nnic3 = socket=dmz\n"
+    vm, err := FromText("/vm/plug", config, nil, (&fakeHost{}).host())
+    if err != nil {
+	t.Fatal(err)
+    }
+    ports := vm.SwitchPorts()
+    want := []SwitchPort{
+	{ Switch: "lab", Port: "plug.vnic1", Addr: "127.0.0.1:1332" },
+	{ Switch: "dmz", Port: "plug.vnic3", Addr: "127.0.0.1:1334" },
+    }
+    if fmt.Sprint(ports) != fmt.Sprint(want) {
+	t.Errorf("ports %v, want %v", ports, want)
+    }
+    env := SwitchEnv(ports)
+    if env != "lab/plug.vnic1,dmz/plug.vnic3" {
+	t.Errorf("env %s", env)
+    }
+    for i, p := range ParseSwitchEnv(env) {
+	if p.Switch != want[i].Switch || p.Port != want[i].Port {
+	    t.Errorf("parsed %v", p)
+	}
+    }
+}
+
+func TestSSHAddr(t *testing.T) {
+    tests := []struct {
+	config string
+	defaults string
+	addr string
+	port int
+    }{
+	{ "id = 3\n", "", "127.0.3.0", 10022 },
+	{ "id = 3\nhostip = offset\n", "", "127.0.0.1", 10052 },
+	// the user defaults count as launch sees them
+	{ "id = 3\n", "hostip = bind 10.0.0.1\nforwards = 2222-22\n", "10.0.0.1", 2222 },
+	{ "id = 3\nnic0 = passt\nforwards = tcp:0.0.0.0:2200-:22\n", "", "127.0.0.1", 2200 },
+	// no forward to ssh, the scheme guesses
+	{ "id = 3\nhostip = offset\nforwards = 10080-80\n", "", "127.0.0.1", 10052 },
+    }
+    for _, tt := range tests {
+	f := &fakeHost{
+	    env: map[string]string{ "HOME": "/home/user" },
+	    pidfiles: map[string]string{},
+	}
+	if tt.defaults != "" {
+	    f.pidfiles["/home/user/.config/vm/defaults"] = tt.defaults
+	}
+	vm, err := FromText("/vm/ssh", "name = ssh\n" + tt.config, nil, f.host())
+	if err != nil {
+	    t.Errorf("%q: %v", tt.config, err)
+	    continue
+	}
+	addr, port := vm.SSHAddr()
+	if addr != tt.addr || port != tt.port {
+	    t.Errorf("%q: %s:%d, want %s:%d", tt.config, addr, port, tt.addr, tt.port)
+	}
+    }
+}
+
+func TestOptions(t *testing.T) {
+    f := &fakeHost{
+	env: map[string]string{ "HOME": "/home/user" },
+	pidfiles: map[string]string{ "/home/user/.config/vm/defaults": "user = me\nhostip = offset\n" },
+    }
+    // qemu would not take it, the options are read anyway
+    config := "name = ci\nid = 3\narch = mips\nkey = id_rsa\n+append = quiet\n"
+    opts := optionsFromText(config, []string{ "user=you" }, f.host())
+    want := map[string]string{ "name": "ci", "id": "3", "arch": "mips", "key": "id_rsa", "append": " quiet", "user": "you", "hostip": "offset" }
+    if !reflect.DeepEqual(opts, want) {
+	t.Errorf("got %v, want %v", opts, want)
+    }
+}
+
+func TestHostArch(t *testing.T) {
+    vm, err := FromText("/vm/s390x", "machine = s390-ccw-virtio\n", nil, (&fakeHost{ arch: "s390x" }).host())
+    if err != nil {
+	t.Fatal(err)
+    }
+    if vm.QemuExec != "qemu-system-s390x" || vm.Accel != "kvm" || vm.VGA != "" {
+	t.Errorf("got %s %s %s", vm.QemuExec, vm.Accel, vm.VGA)
+    }
+    // only the host itself
+    if _, err := FromText("/vm/s390x", "arch = s390x\n", nil, (&fakeHost{}).host()); err == nil {
+	t.Errorf("arch = s390x on x86_64 is taken")
+    }
+}
+
+func TestMachine(t *testing.T) {
+    for _, m := range []string{ "q35", "pc-q35-8.2", "pc-i440fx-7.0", "microvm", "q35,smm=on" } {
+	vm, err := FromText("/vm/m", "machine = " + m + "\n", nil, (&fakeHost{}).host())
+	if err != nil || vm.Machine != m {
+	    t.Errorf("%s: %v", m, err)
+	}
+    }
+}
+
+func TestMem(t *testing.T) {
+    for _, m := range []string{ "4G", "1.5G", "4G,slots=2,maxmem=8G" } {
+	vm, err := FromText("/vm/mem", "mem = " + m + "\n", nil, (&fakeHost{}).host())
+	if err != nil {
+	    t.Fatalf("%s: %v", m, err)
+	}
+	args := strings.Join(vm.Qemu().Args, " ")
+	if !strings.Contains(args, " -m " + m + " ") {
+	    t.Errorf("%s: got %s", m, args)
+	}
+    }
+}
+
+func TestShellQuote(t *testing.T) {
+    got := ShellQuote([]string{ "qemu", "-name", "a b", "it's", "", "file=x,if=virtio" })
+    want := `qemu -name 'a b' 'it'\''s' '' file=x,if=virtio`
+    if got != want {
+	t.Errorf("got %s, want %s", got, want)
+    }
+}
+
+func TestBuilderAPI(t *testing.T) {
+    vm := newVM("api", (&fakeHost{}).host())
+    vm.Dir = "/vm/api"
+    vm.Accel = "kvm"
+    vm.ID = 7
+    vm.Mem = "2G"
+    nic, net := vm.NewNIC(0)
+    net.HostFwds = vm.DefaultForwards(0)
+    vm.AddNetwork(nic, net).
+	AddDrive(Drive{ Path: "root.qcow2", Format: "qcow2", Interface: "virtio" }).
+	AddUSBStorage(Drive{ Path: "stick.raw", Format: "raw", ID: "stick" }, "xhci").
+	AddVirtfs(NewVirtfs(0, "/srv/share"))
+    if err := vm.Validate(); err != nil {
+	t.Fatalf("Validate: %v", err)
+    }
+    checkGolden(t, "api", render(vm))
+    // the exported JSON needs its host back
+    data, err := json.Marshal(vm)
+    if err != nil {
+	t.Fatal(err)
+    }
+    again := &VMConfig{}
+    if err := json.Unmarshal(data, again); err != nil {
+	t.Fatal(err)
+    }
+    if err := again.Validate(); err == nil || err.Error() != "validate: no host" {
+	t.Errorf("unmarshalled: %v", err)
+    }
+    if err := again.SetHost((&fakeHost{}).host()).Validate(); err != nil {
+	t.Errorf("with host: %v", err)
+    }
+}
+
+func TestValidate(t *testing.T) {
+    tests := []struct {
+	name string
+	modify func(vm *VMConfig)
+	err string
+    }{
+	{ "noname", func(vm *VMConfig) { vm.Name = "" }, "validate: no name" },
+	{ "id", func(vm *VMConfig) { vm.ID = 65536 }, "validate: id 65536 out of range" },
+	{ "drive", func(vm *VMConfig) { vm.AddDrive(Drive{ Format: "raw" }) }, "validate: drive without path" },
+	{ "netdev", func(vm *VMConfig) { vm.NICs[0].Netdev = "vnic9" }, "validate: nic uses unknown netdev vnic9" },
+	{ "nettype", func(vm *VMConfig) { vm.Networks[0].Type = "vde" }, "validate: vnic0 unknown network type vde" },
+	{ "usbbus", func(vm *VMConfig) { vm.USBDevices = append(vm.USBDevices, USBDevice{ Bus: "ehci", Device: "storage" }) },
+	    "validate: usb device on unknown bus ehci" },
+	{ "usbdrive", func(vm *VMConfig) { vm.AddUSBDevice(USBDevice{ Device: "storage", Drive: "none" }) },
+	    "validate: usb storage uses unknown drive none" },
+	{ "firmware", func(vm *VMConfig) { vm.Firmware.Code = "OVMF_CODE.fd" }, "validate: firmware code without vars" },
+	{ "host", func(vm *VMConfig) { vm.SetHost(nil) }, "validate: no host" },
+	{ "hostip", func(vm *VMConfig) { vm.HostIP = nil }, "validate: no hostip" },
+    }
+    for _, tt := range tests {
+	vm := newVM("valid", (&fakeHost{}).host())
+	vm.AddNetwork(vm.NewNIC(0))
+	tt.modify(vm)
+	err := vm.Validate()
+	if err == nil || err.Error() != tt.err {
+	    t.Errorf("%s: got %v, want %s", tt.name, err, tt.err)
+	}
+    }
+}
+
+func TestResources(t *testing.T) {
+    vm, err := FromText("/vm/res", "cgroup = user.slice/vm.slice\ncpu.max = 200000 100000\nio.weight = 200\n", nil, (&fakeHost{}).host())
+    if err != nil {
+	t.Fatal(err)
+    }
+    limits := vm.Resources.Limits()
+    if len(limits) != 2 || limits["cpu.max"] != "200000 100000" || limits["io.weight"] != "default 200" {
+	t.Errorf("limits %v", limits)
+    }
+    if vm.Resources.Parent != "user.slice/vm.slice" {
+	t.Errorf("parent %s", vm.Resources.Parent)
+    }
+    if n := len(vm.Resources.Controllers()); n != 2 {
+	t.Errorf("controllers %v", vm.Resources.Controllers())
+    }
+    vm.Resources = Resources{}
+    if vm.Resources.Limits() != nil {
+	t.Errorf("no limits expected")
+    }
+}
+
+func TestCPUPin(t *testing.T) {
+    tests := []struct {
+	val string
+	want string
+    }{
+	{ "2-4", "[{0 [2]} {1 [3]} {2 [4]}]" },
+	{ "0:2 1:3-4,8", "[{0 [2]} {1 [3 4 8]}]" },
+	{ "5", "[{0 [5]}]" },
+    }
+    for _, tt := range tests {
+	pins, err := parseCPUPin(tt.val)
+	if err != nil {
+	    t.Errorf("%s: %v", tt.val, err)
+	    continue
+	}
+	if got := fmt.Sprint(pins); got != tt.want {
+	    t.Errorf("%s: got %s, want %s", tt.val, got, tt.want)
+	}
+    }
+}
+
+func TestCheckShares(t *testing.T) {
+    config := "mem = 1G\nvirtfs0 = /srv/share\nvirtiofs0 = data\n"
+    tests := []struct {
+	missing string
+	err string
+    }{
+	{ "", "" },
+	{ "/srv/share", "check: virtfs0 stat /srv/share: no such file or directory" },
+	{ "/vm/share/data", "check: virtiofs0 stat /vm/share/data: no such file or directory" },
+    }
+    for _, tt := range tests {
+	host := &fakeHost{ missing: []string{ tt.missing } }
+	vm, err := FromText("/vm/share", config, nil, host.host())
+	if err != nil {
+	    t.Fatal(err)
+	}
+	err = vm.Check()
+	if got := fmt.Sprint(err); (err == nil && tt.err != "") || (err != nil && got != tt.err) {
+	    t.Errorf("%s: got %v, want %s", tt.missing, err, tt.err)
+	}
+    }
+}
+
+func TestCheckHugepages(t *testing.T) {
+    meminfo := "MemTotal:       16318496 kB\nHugePages_Total:    1024\nHugePages_Free:      512\nHugepagesize:       2048 kB\n"
+    tests := []struct {
+	mem string
+	ok bool
+    }{
+	{ "1G", true },
+	{ "1025M", false },
+	{ "2G", false },
+	{ "0.5G", true },
+	{ "1.5G", false },
+	{ "512M,slots=2,maxmem=8G", true },
+	{ "size=1G,maxmem=8G", true },
+    }
+    for _, tt := range tests {
+	host := &fakeHost{ pidfiles: map[string]string{ "/proc/meminfo": meminfo } }
+	vm, err := FromText("/vm/huge", "mem = " + tt.mem + " hugepages\n", nil, host.host())
+	if err != nil {
+	    t.Fatal(err)
+	}
+	if err := vm.Check(); (err == nil) != tt.ok {
+	    t.Errorf("%s: %v", tt.mem, err)
+	}
+    }
+}
+
+func TestHelperPids(t *testing.T) {
+    dir := t.TempDir()
+    cmd := exec.Command("sh", "-c", "sleep 10", "virtiofs0.sock")
+    // passt leaves the directory, the start time finds it still
+    passt := exec.Command("sh", "-c", "sleep 10", "--socket", "passt0.sock")
+    cmd.Dir = dir
+    if err := cmd.Start(); err != nil {
+	t.Skip(err)
+    }
+    defer cmd.Wait()
+    defer cmd.Process.Kill()
+    if err := passt.Start(); err != nil {
+	t.Fatal(err)
+    }
+    defer passt.Wait()
+    defer passt.Process.Kill()
+    write := func(name, content string) {
+	h := Helper{ Name: name }
+	ioutil.WriteFile(filepath.Join(dir, h.pidfile()), []byte(content), 0644)
+    }
+    // an older pidfile without the start time
+    write("virtiofs0", fmt.Sprintf("%d\n", cmd.Process.Pid))
+    write("passt0", fmt.Sprintf("%d %s\n", passt.Process.Pid, starttime(passt.Process.Pid)))
+    // stale pidfiles naming someone else, here the test itself
+    write("virtiofs1", fmt.Sprintf("%d\n", os.Getpid()))
+    write("passt1", fmt.Sprintf("%d 1\n", os.Getpid()))
+    // cmdline is written once the children have exec'ed sh
+    deadline := time.Now().Add(time.Second)
+    for len(HelperPids(dir)) < 2 && time.Now().Before(deadline) {
+	time.Sleep(10 * time.Millisecond)
+    }
+    pids := HelperPids(dir)
+    if len(pids) != 2 || pids["virtiofs0"] != cmd.Process.Pid || pids["passt0"] != passt.Process.Pid {
+	t.Fatalf("pids %v", pids)
+    }
+    CleanHelpers(dir)
+    files, _ := filepath.Glob(filepath.Join(dir, "helper-*.pid"))
+    if len(files) != 2 {
+	t.Fatalf("after clean %v", files)
+    }
+    StopHelpers(dir)
+    if files, _ := filepath.Glob(filepath.Join(dir, "helper-*.pid")); len(files) != 0 {
+	t.Errorf("pidfiles are left %v", files)
+    }
+}
@@ -0,0 +1,95 @@
+// vm/qemu / resources.go
+//
+// MIT License Copyright(c) 2021 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+//
+package qemu
+
+import (
+    "fmt"
+    "strconv"
+    "strings"
+)
+
+// Resources are the cgroup v2 limits put on the qemu process
+type Resources struct {
+    // Parent is the cgroup to create the VM group in,
+    // relative to the cgroup root. When empty it is next to our own
+    // if that is delegated to us, else our user@<uid>.service
+    Parent string `json:"parent,omitempty"`
+    CPUWeight string `json:"cpu.weight,omitempty"`
+    CPUMax string `json:"cpu.max,omitempty"`
+    MemoryMax string `json:"memory.max,omitempty"`
+    MemoryHigh string `json:"memory.high,omitempty"`
+    IOWeight string `json:"io.weight,omitempty"`
+}
+
+// Limits returns the cgroup files to write, nil when nothing is limited
+func (r *Resources)Limits() map[string]string {
+    limits := map[string]string{}
+    set := func(file, val string) {
+	if val != "" {
+	    limits[file] = val
+	}
+    }
+    set("cpu.weight", r.CPUWeight)
+    set("cpu.max", r.CPUMax)
+    set("memory.max", r.MemoryMax)
+    set("memory.high", r.MemoryHigh)
+    if r.IOWeight != "" {
+	limits["io.weight"] = "default " + r.IOWeight
+    }
+    if len(limits) == 0 {
+	return nil
+    }
+    return limits
+}
+
+// Controllers lists the controllers the limits need
+func (r *Resources)Controllers() []string {
+    controllers := []string{}
+    seen := map[string]bool{}
+    for file := range r.Limits() {
+	c := strings.SplitN(file, ".", 2)[0]
+	if !seen[c] {
+	    seen[c] = true
+	    controllers = append(controllers, c)
+	}
+    }
+    return controllers
+}
+
+func (r *Resources)validate() error {
+    weight := func(key, val string) error {
+	if val == "" {
+	    return nil
+	}
+	n, err := strconv.Atoi(val)
+	if err != nil || n < 1 || n > 10000 {
+	    return fmt.Errorf("validate: %s %q not in 1-10000", key, val)
+	}
+	return nil
+    }
+    if err := weight("cpu.weight", r.CPUWeight); err != nil {
+	return err
+    }
+    if err := weight("io.weight", r.IOWeight); err != nil {
+	return err
+    }
+    if r.CPUMax != "" {
+	// $MAX [$PERIOD]
+	f := strings.Fields(r.CPUMax)
+	if len(f) > 2 {
+	    return fmt.Errorf("validate: cpu.max %q", r.CPUMax)
+	}
+	for i, v := range f {
+	    if i == 0 && v == "max" {
+		continue
+	    }
+	    if _, err := strconv.Atoi(v); err != nil {
+		return fmt.Errorf("validate: cpu.max %q", r.CPUMax)
+	    }
+	}
+    }
+    return nil
+}
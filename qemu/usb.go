@@ -9,24 +9,24 @@ import (
     "strings"
 )
 
-type usbhost struct {
-    id string
+type USBHost struct {
+    ID string `json:"id"`
 }
 
-type usb struct {
-    bus string // attached host
-    device string // device type
-    drive string // drive id
+type USBDevice struct {
+    Bus string `json:"bus,omitempty"` // attached host
+    Device string `json:"device"` // device type
+    Drive string `json:"drive,omitempty"` // drive id
 }
 
-func (u *usb)value() string {
+func (u *USBDevice)value() string {
     v := []string{}
-    if u.device == "storage" {
+    if u.Device == "storage" {
 	v = append(v, "usb-storage")
-	if u.bus != "" {
-	    v = append(v, "bus=" + u.bus + ".0")
+	if u.Bus != "" {
+	    v = append(v, "bus=" + u.Bus + ".0")
 	}
-	v = push(v, "drive", u.drive)
+	v = push(v, "drive", u.Drive)
     }
     return strings.Join(v, ",")
 }
@@ -0,0 +1,224 @@
+// vm/qemu / virtfs.go
+//
+// MIT License Copyright(c) 2018,2019,2020,2021 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+//
+package qemu
+
+import (
+    "fmt"
+    "path/filepath"
+    "strconv"
+    "strings"
+)
+
+// Virtfs is a 9p share,
+// virtfsN = [path=]path [tag=name] [readonly] [security_model=model]
+//           [multidevs=remap|forbid|warn] [fmode=0644] [dmode=0755] [driver=local]
+type Virtfs struct {
+    Driver string `json:"driver"`
+    ID string `json:"id"`
+    Path string `json:"path"`
+    MountTag string `json:"mount_tag"`
+    SecurityModel string `json:"security_model"`
+    Multidevs string `json:"multidevs,omitempty"`
+    // file and directory modes for the mapped security models
+    Fmode string `json:"fmode,omitempty"`
+    Dmode string `json:"dmode,omitempty"`
+    ReadOnly bool `json:"readonly"`
+}
+
+// NewVirtfs returns the share for virtfsN, mounted as ground, ground1, ...
+func NewVirtfs(inst int, path string) Virtfs {
+    v := Virtfs{
+	Driver: "local",
+	ID: fmt.Sprintf("virtfs%d", inst),
+	Path: path,
+	MountTag: "ground",
+	SecurityModel: "none",
+	ReadOnly: false,
+    }
+    if inst > 0 {
+	v.MountTag = fmt.Sprintf("ground%d", inst)
+    }
+    return v
+}
+
+func (f *Virtfs)value() string {
+    v := []string{ f.Driver }
+    v = push(v, "id", f.ID)
+    v = push(v, "path", f.Path)
+    v = push(v, "mount_tag", f.MountTag)
+    v = push(v, "security_model", f.SecurityModel)
+    v = push(v, "multidevs", f.Multidevs)
+    v = push(v, "fmode", f.Fmode)
+    v = push(v, "dmode", f.Dmode)
+    if f.ReadOnly {
+	v = append(v, "readonly")
+    }
+    return strings.Join(v, ",")
+}
+
+// parseShare walks the words of a share option, the path may be given
+// bare once, other words go to opt which reports whether it knew them
+func parseShare(id, val string, opt func(key, v string) bool) (string, error) {
+    path := ""
+    for _, word := range strings.Fields(val) {
+	key, v := keyval(word)
+	if key == "path" || !strings.Contains(word, "=") && word != "readonly" {
+	    if key != "path" {
+		v = word
+	    }
+	    if path != "" {
+		return "", fmt.Errorf("%s: unknown %q, path is %s", id, word, path)
+	    }
+	    path = v
+	    continue
+	}
+	if !opt(key, v) {
+	    return "", fmt.Errorf("%s: unknown %q", id, word)
+	}
+    }
+    if path == "" {
+	return "", fmt.Errorf("%s: no path", id)
+    }
+    return path, nil
+}
+
+func parseVirtfs(inst int, val string) (Virtfs, error) {
+    v := NewVirtfs(inst, "")
+    path, err := parseShare(v.ID, val, func(key, val string) bool {
+	switch key {
+	case "tag": v.MountTag = val
+	case "readonly": v.ReadOnly = true
+	case "security_model": v.SecurityModel = val
+	case "multidevs": v.Multidevs = val
+	case "fmode": v.Fmode = val
+	case "dmode": v.Dmode = val
+	case "driver": v.Driver = val
+	default: return false
+	}
+	return true
+    })
+    v.Path = path
+    return v, err
+}
+
+func (f *Virtfs)validate() error {
+    switch f.Driver {
+    case "local", "proxy", "synth":
+    default:
+	return fmt.Errorf("validate: %s unknown driver %s", f.ID, f.Driver)
+    }
+    mapped := false
+    switch f.SecurityModel {
+    case "mapped", "mapped-xattr", "mapped-file":
+	mapped = true
+    case "none", "passthrough":
+    default:
+	return fmt.Errorf("validate: %s unknown security_model %s", f.ID, f.SecurityModel)
+    }
+    switch f.Multidevs {
+    case "", "remap", "forbid", "warn":
+    default:
+	return fmt.Errorf("validate: %s unknown multidevs %s", f.ID, f.Multidevs)
+    }
+    for _, mode := range []string{ f.Fmode, f.Dmode } {
+	if mode == "" {
+	    continue
+	}
+	if !mapped {
+	    return fmt.Errorf("validate: %s fmode and dmode need a mapped security_model", f.ID)
+	}
+	if _, err := strconv.ParseUint(mode, 8, 32); err != nil {
+	    return fmt.Errorf("validate: %s bad mode %s", f.ID, mode)
+	}
+    }
+    return nil
+}
+
+// Virtiofs is a share served by virtiofsd, virtiofsN = path [tag=name] [readonly]
+type Virtiofs struct {
+    ID string `json:"id"`
+    Path string `json:"path"`
+    MountTag string `json:"mount_tag"`
+    ReadOnly bool `json:"readonly"`
+}
+
+func NewVirtiofs(inst int, path string) Virtiofs {
+    return Virtiofs{
+	ID: fmt.Sprintf("virtiofs%d", inst),
+	Path: path,
+	MountTag: fmt.Sprintf("fs%d", inst),
+    }
+}
+
+func parseVirtiofs(inst int, val string) (Virtiofs, error) {
+    fs := NewVirtiofs(inst, "")
+    path, err := parseShare(fs.ID, val, func(key, val string) bool {
+	switch key {
+	case "tag": fs.MountTag = val
+	case "readonly": fs.ReadOnly = true
+	default: return false
+	}
+	return true
+    })
+    fs.Path = path
+    return fs, err
+}
+
+func (f *Virtiofs)socket() string {
+    return f.ID + ".sock"
+}
+
+// helper returns virtiofsd for the share, virtiofsd may carry extra options
+func (f *Virtiofs)helper(virtiofsd string) Helper {
+    cmd := strings.Fields(virtiofsd)
+    args := append(cmd[1:],
+	"--socket-path=" + f.socket(),
+	"--shared-dir=" + f.Path,
+	"--cache=auto")
+    if f.ReadOnly {
+	args = append(args, "--readonly")
+    }
+    return Helper{ Name: f.ID, Exec: cmd[0], Args: args, Socket: f.socket() }
+}
+
+func (vm *VMConfig)virtiofs() {
+    for _, fs := range vm.Virtiofs {
+	vm.push("-chardev", "socket,id=" + fs.ID + ",path=" + fs.socket())
+	vm.push("-device", "vhost-user-fs-pci,chardev=" + fs.ID + ",tag=" + fs.MountTag)
+    }
+}
+
+// checkShares makes sure the shared directories are there,
+// qemu and virtiofsd only complain once the guest is booting
+func (vm *VMConfig)checkShares() error {
+    check := func(id, path string) error {
+	if !filepath.IsAbs(path) {
+	    path = filepath.Join(vm.Dir, path)
+	}
+	info, err := vm.host.Stat(path)
+	if err != nil {
+	    return fmt.Errorf("check: %s %v", id, err)
+	}
+	if !info.IsDir() {
+	    return fmt.Errorf("check: %s %s is not a directory", id, path)
+	}
+	return nil
+    }
+    for _, v := range vm.Virtfs {
+	if v.Driver == "synth" {
+	    continue
+	}
+	if err := check(v.ID, v.Path); err != nil {
+	    return err
+	}
+    }
+    for _, fs := range vm.Virtiofs {
+	if err := check(fs.ID, fs.Path); err != nil {
+	    return err
+	}
+    }
+    return nil
+}
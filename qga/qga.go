@@ -0,0 +1,278 @@
+// vm/qga
+//
+// MIT License Copyright(c) 2021 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+//
+package qga
+
+import (
+    "bufio"
+    "encoding/base64"
+    "encoding/json"
+    "fmt"
+    "math/rand"
+    "net"
+    "time"
+)
+
+// Agent talks to qemu-guest-agent through the chardev socket of the VM
+type Agent struct {
+    conn net.Conn
+    r *bufio.Reader
+    timeout time.Duration
+}
+
+type agentError struct {
+    Class string `json:"class"`
+    Desc string `json:"desc"`
+}
+
+type response struct {
+    Return json.RawMessage `json:"return"`
+    Error *agentError `json:"error"`
+}
+
+// Dial connects to the socket and synchronizes with the agent,
+// timeout applies to every command
+func Dial(path string, timeout time.Duration) (*Agent, error) {
+    conn, err := net.DialTimeout("unix", path, timeout)
+    if err != nil {
+	return nil, err
+    }
+    a, err := newAgent(conn, timeout)
+    if err != nil {
+	conn.Close()
+	return nil, err
+    }
+    return a, nil
+}
+
+func newAgent(conn net.Conn, timeout time.Duration) (*Agent, error) {
+    a := &Agent{ conn: conn, r: bufio.NewReader(conn), timeout: timeout }
+    if err := a.sync(); err != nil {
+	return nil, err
+    }
+    return a, nil
+}
+
+func (a *Agent)Close() error {
+    return a.conn.Close()
+}
+
+// sync drops whatever an earlier client left in the channel,
+// the agent answers guest-sync-delimited after a 0xff marker
+func (a *Agent)sync() error {
+    id := rand.Int63n(1 << 31)
+    a.conn.SetDeadline(time.Now().Add(a.timeout))
+    defer a.conn.SetDeadline(time.Time{})
+    req := fmt.Sprintf(`{"execute":"guest-sync-delimited","arguments":{"id":%d}}`, id)
+    if _, err := a.conn.Write([]byte("\xff" + req + "\n")); err != nil {
+	return fmt.Errorf("qga: sync %v", err)
+    }
+    for {
+	if _, err := a.r.ReadBytes(0xff); err != nil {
+	    return fmt.Errorf("qga: sync %v", err)
+	}
+	line, err := a.r.ReadBytes('\n')
+	if err != nil {
+	    return fmt.Errorf("qga: sync %v", err)
+	}
+	var resp struct {
+	    Return int64 `json:"return"`
+	}
+	if json.Unmarshal(line, &resp) == nil && resp.Return == id {
+	    return nil
+	}
+    }
+}
+
+// Execute runs cmd with args and stores the return value in ret
+func (a *Agent)Execute(cmd string, args interface{}, ret interface{}) error {
+    req := map[string]interface{}{ "execute": cmd }
+    if args != nil {
+	req["arguments"] = args
+    }
+    data, err := json.Marshal(req)
+    if err != nil {
+	return err
+    }
+    a.conn.SetDeadline(time.Now().Add(a.timeout))
+    defer a.conn.SetDeadline(time.Time{})
+    if _, err := a.conn.Write(append(data, '\n')); err != nil {
+	return fmt.Errorf("qga: %s %v", cmd, err)
+    }
+    line, err := a.r.ReadBytes('\n')
+    if err != nil {
+	return fmt.Errorf("qga: %s %v", cmd, err)
+    }
+    var resp response
+    if err := json.Unmarshal(line, &resp); err != nil {
+	return fmt.Errorf("qga: %s %v", cmd, err)
+    }
+    if resp.Error != nil {
+	return fmt.Errorf("qga: %s %s: %s", cmd, resp.Error.Class, resp.Error.Desc)
+    }
+    if ret != nil && resp.Return != nil {
+	return json.Unmarshal(resp.Return, ret)
+    }
+    return nil
+}
+
+func (a *Agent)Ping() error {
+    return a.Execute("guest-ping", nil, nil)
+}
+
+// FsFreeze freezes the guest filesystems and returns how many were frozen
+func (a *Agent)FsFreeze() (int, error) {
+    n := 0
+    err := a.Execute("guest-fsfreeze-freeze", nil, &n)
+    return n, err
+}
+
+func (a *Agent)FsThaw() (int, error) {
+    n := 0
+    err := a.Execute("guest-fsfreeze-thaw", nil, &n)
+    return n, err
+}
+
+type IPAddress struct {
+    Type string `json:"ip-address-type"`
+    Address string `json:"ip-address"`
+    Prefix int `json:"prefix"`
+}
+
+type Interface struct {
+    Name string `json:"name"`
+    HardwareAddress string `json:"hardware-address"`
+    IPAddresses []IPAddress `json:"ip-addresses"`
+}
+
+func (a *Agent)NetworkInterfaces() ([]Interface, error) {
+    ifs := []Interface{}
+    err := a.Execute("guest-network-get-interfaces", nil, &ifs)
+    return ifs, err
+}
+
+type ExecResult struct {
+    ExitCode int
+    Signal int
+    Stdout, Stderr []byte
+}
+
+// Exec runs path in the guest with input as stdin and waits for it
+// up to timeout, 0 waits as long as it runs
+func (a *Agent)Exec(path string, args []string, input []byte, timeout time.Duration) (*ExecResult, error) {
+    req := map[string]interface{}{
+	"path": path,
+	"arg": args,
+	"capture-output": true,
+    }
+    if input != nil {
+	req["input-data"] = base64.StdEncoding.EncodeToString(input)
+    }
+    var started struct {
+	Pid int `json:"pid"`
+    }
+    if err := a.Execute("guest-exec", req, &started); err != nil {
+	return nil, err
+    }
+    deadline := time.Now().Add(timeout)
+    for {
+	var status struct {
+	    Exited bool `json:"exited"`
+	    ExitCode int `json:"exitcode"`
+	    Signal int `json:"signal"`
+	    OutData string `json:"out-data"`
+	    ErrData string `json:"err-data"`
+	}
+	if err := a.Execute("guest-exec-status", map[string]int{ "pid": started.Pid }, &status); err != nil {
+	    return nil, err
+	}
+	if !status.Exited {
+	    if timeout > 0 && time.Now().After(deadline) {
+		return nil, fmt.Errorf("qga: %s pid %d still runs after %v", path, started.Pid, timeout)
+	    }
+	    time.Sleep(100 * time.Millisecond)
+	    continue
+	}
+	res := &ExecResult{ ExitCode: status.ExitCode, Signal: status.Signal }
+	var err error
+	if res.Stdout, err = base64.StdEncoding.DecodeString(status.OutData); err != nil {
+	    return nil, fmt.Errorf("qga: stdout %v", err)
+	}
+	if res.Stderr, err = base64.StdEncoding.DecodeString(status.ErrData); err != nil {
+	    return nil, fmt.Errorf("qga: stderr %v", err)
+	}
+	return res, nil
+    }
+}
+
+func (a *Agent)fileOpen(path, mode string) (int, error) {
+    handle := 0
+    err := a.Execute("guest-file-open", map[string]string{ "path": path, "mode": mode }, &handle)
+    return handle, err
+}
+
+func (a *Agent)fileClose(handle int) error {
+    return a.Execute("guest-file-close", map[string]int{ "handle": handle }, nil)
+}
+
+// FileRead reads the whole guest file
+func (a *Agent)FileRead(path string) ([]byte, error) {
+    handle, err := a.fileOpen(path, "r")
+    if err != nil {
+	return nil, err
+    }
+    defer a.fileClose(handle)
+    data := []byte{}
+    for {
+	var chunk struct {
+	    Count int `json:"count"`
+	    BufB64 string `json:"buf-b64"`
+	    EOF bool `json:"eof"`
+	}
+	args := map[string]int{ "handle": handle, "count": 65536 }
+	if err := a.Execute("guest-file-read", args, &chunk); err != nil {
+	    return nil, err
+	}
+	buf, err := base64.StdEncoding.DecodeString(chunk.BufB64)
+	if err != nil {
+	    return nil, fmt.Errorf("qga: read %v", err)
+	}
+	data = append(data, buf...)
+	if chunk.EOF || chunk.Count == 0 {
+	    return data, nil
+	}
+    }
+}
+
+// FileWrite replaces the guest file with data
+func (a *Agent)FileWrite(path string, data []byte) error {
+    handle, err := a.fileOpen(path, "w")
+    if err != nil {
+	return err
+    }
+    for len(data) > 0 {
+	n := len(data)
+	if n > 65536 {
+	    n = 65536
+	}
+	args := map[string]interface{}{
+	    "handle": handle,
+	    "buf-b64": base64.StdEncoding.EncodeToString(data[:n]),
+	}
+	var written struct {
+	    Count int `json:"count"`
+	}
+	if err := a.Execute("guest-file-write", args, &written); err != nil {
+	    a.fileClose(handle)
+	    return err
+	}
+	if written.Count <= 0 {
+	    a.fileClose(handle)
+	    return fmt.Errorf("qga: write %s short", path)
+	}
+	data = data[written.Count:]
+    }
+    return a.fileClose(handle)
+}
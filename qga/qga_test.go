@@ -0,0 +1,118 @@
+// vm/qga / qga_test.go
+//
+// MIT License Copyright(c) 2021 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+//
+package qga
+
+import (
+    "bufio"
+    "encoding/json"
+    "fmt"
+    "net"
+    "strings"
+    "testing"
+    "time"
+)
+
+// fakeAgent has a stale reply in the channel like an earlier client
+// left it, then answers each command with the line in replies
+func fakeAgent(t *testing.T, conn net.Conn, replies map[string]string) {
+    r := bufio.NewReader(conn)
+    for {
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+	    return
+	}
+	var req struct {
+	    Execute string `json:"execute"`
+	    Arguments struct {
+		ID int64 `json:"id"`
+	    } `json:"arguments"`
+	}
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(string(line), "\xff")), &req); err != nil {
+	    t.Errorf("bad request %q", line)
+	    return
+	}
+	if req.Execute == "guest-sync-delimited" {
+	    if line[0] != 0xff {
+		t.Errorf("sync without marker")
+	    }
+	    conn.Write([]byte(`{"return": {}}` + "\n"))
+	    conn.Write([]byte(fmt.Sprintf("\xff{\"return\": %d}\n", req.Arguments.ID)))
+	    continue
+	}
+	if reply, ok := replies[req.Execute]; ok {
+	    conn.Write([]byte(reply + "\n"))
+	}
+    }
+}
+
+func TestAgent(t *testing.T) {
+    near, far := net.Pipe()
+    defer near.Close()
+    go fakeAgent(t, far, map[string]string{
+	"guest-ping": `{"return": {}}`,
+	"guest-fsfreeze-freeze": `{"return": 2}`,
+	"guest-fsfreeze-thaw": `{"error": {"class": "GenericError", "desc": "not frozen"}}`,
+    })
+    a, err := newAgent(near, time.Second)
+    if err != nil {
+	t.Fatal(err)
+    }
+    if err := a.Ping(); err != nil {
+	t.Errorf("ping %v", err)
+    }
+    if n, err := a.FsFreeze(); err != nil || n != 2 {
+	t.Errorf("freeze %d %v", n, err)
+    }
+    if _, err := a.FsThaw(); err == nil || err.Error() != "qga: guest-fsfreeze-thaw GenericError: not frozen" {
+	t.Errorf("thaw %v", err)
+    }
+}
+
+func TestAgentTimeout(t *testing.T) {
+    near, far := net.Pipe()
+    defer near.Close()
+    // guest-ping is never answered, no agent runs in the guest
+    go fakeAgent(t, far, nil)
+    a, err := newAgent(near, 100 * time.Millisecond)
+    if err != nil {
+	t.Fatal(err)
+    }
+    if err := a.Ping(); err == nil || !strings.Contains(err.Error(), "timeout") {
+	t.Errorf("ping %v", err)
+    }
+}
+
+func TestExec(t *testing.T) {
+    tests := []struct {
+	status string
+	out string
+	err string
+    }{
+	{ `{"return": {"exited": true, "exitcode": 0, "out-data": "aGkK"}}`, "hi\n", "" },
+	// still running when the time is up
+	{ `{"return": {"exited": false}}`, "", "qga: /bin/sleep pid 7 still runs after 300ms" },
+    }
+    for _, tt := range tests {
+	near, far := net.Pipe()
+	go fakeAgent(t, far, map[string]string{
+	    "guest-exec": `{"return": {"pid": 7}}`,
+	    "guest-exec-status": tt.status,
+	})
+	a, err := newAgent(near, time.Second)
+	if err != nil {
+	    t.Fatal(err)
+	}
+	res, err := a.Exec("/bin/sleep", []string{ "10" }, nil, 300 * time.Millisecond)
+	if tt.err != "" {
+	    if err == nil || err.Error() != tt.err {
+		t.Errorf("got error %v, want %s", err, tt.err)
+	    }
+	} else if err != nil || string(res.Stdout) != tt.out {
+	    t.Errorf("got %v %v", res, err)
+	}
+	near.Close()
+    }
+}
@@ -0,0 +1,131 @@
+// vm/qmp
+//
+// MIT License Copyright(c) 2021 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+//
+package qmp
+
+import (
+    "bufio"
+    "encoding/json"
+    "fmt"
+    "net"
+    "time"
+)
+
+// Monitor is a connection to the QMP socket of a running qemu
+type Monitor struct {
+    conn net.Conn
+    r *bufio.Reader
+    timeout time.Duration
+}
+
+type qmpError struct {
+    Class string `json:"class"`
+    Desc string `json:"desc"`
+}
+
+type response struct {
+    QMP json.RawMessage `json:"QMP"`
+    Event string `json:"event"`
+    Return json.RawMessage `json:"return"`
+    Error *qmpError `json:"error"`
+}
+
+// Dial connects to the socket and leaves capabilities negotiation mode,
+// timeout applies to every command
+func Dial(path string, timeout time.Duration) (*Monitor, error) {
+    conn, err := net.DialTimeout("unix", path, timeout)
+    if err != nil {
+	return nil, err
+    }
+    m, err := newMonitor(conn, timeout)
+    if err != nil {
+	conn.Close()
+	return nil, err
+    }
+    return m, nil
+}
+
+func newMonitor(conn net.Conn, timeout time.Duration) (*Monitor, error) {
+    m := &Monitor{ conn: conn, r: bufio.NewReader(conn), timeout: timeout }
+    // greeting
+    conn.SetDeadline(time.Now().Add(timeout))
+    var greeting response
+    if err := m.read(&greeting); err != nil {
+	return nil, fmt.Errorf("qmp: greeting %v", err)
+    }
+    if greeting.QMP == nil {
+	return nil, fmt.Errorf("qmp: bad greeting")
+    }
+    if err := m.Execute("qmp_capabilities", nil, nil); err != nil {
+	return nil, err
+    }
+    return m, nil
+}
+
+func (m *Monitor)Close() error {
+    return m.conn.Close()
+}
+
+func (m *Monitor)read(v interface{}) error {
+    line, err := m.r.ReadBytes('\n')
+    if err != nil {
+	return err
+    }
+    return json.Unmarshal(line, v)
+}
+
+// Execute runs cmd with args and stores the return value in ret,
+// events arriving in between are skipped
+func (m *Monitor)Execute(cmd string, args interface{}, ret interface{}) error {
+    req := map[string]interface{}{ "execute": cmd }
+    if args != nil {
+	req["arguments"] = args
+    }
+    data, err := json.Marshal(req)
+    if err != nil {
+	return err
+    }
+    // a wedged qemu must not hang us
+    m.conn.SetDeadline(time.Now().Add(m.timeout))
+    defer m.conn.SetDeadline(time.Time{})
+    if _, err := m.conn.Write(append(data, '\n')); err != nil {
+	return fmt.Errorf("qmp: %s %v", cmd, err)
+    }
+    for {
+	var resp response
+	if err := m.read(&resp); err != nil {
+	    return fmt.Errorf("qmp: %s %v", cmd, err)
+	}
+	if resp.Event != "" {
+	    continue
+	}
+	if resp.Error != nil {
+	    return fmt.Errorf("qmp: %s %s: %s", cmd, resp.Error.Class, resp.Error.Desc)
+	}
+	if ret != nil && resp.Return != nil {
+	    return json.Unmarshal(resp.Return, ret)
+	}
+	return nil
+    }
+}
+
+// HumanMonitorCommand runs a HMP command line and returns its output
+func (m *Monitor)HumanMonitorCommand(line string) (string, error) {
+    out := ""
+    args := map[string]string{ "command-line": line }
+    if err := m.Execute("human-monitor-command", args, &out); err != nil {
+	return "", err
+    }
+    return out, nil
+}
+
+// Powerdown sends the ACPI power button event
+func (m *Monitor)Powerdown() error {
+    return m.Execute("system_powerdown", nil, nil)
+}
+
+func (m *Monitor)Quit() error {
+    return m.Execute("quit", nil, nil)
+}
@@ -0,0 +1,99 @@
+// vm/qmp / qmp_test.go
+//
+// MIT License Copyright(c) 2021 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+//
+package qmp
+
+import (
+    "bufio"
+    "encoding/json"
+    "net"
+    "strings"
+    "testing"
+    "time"
+)
+
+// fakeQemu answers each command with the lines in replies
+func fakeQemu(t *testing.T, conn net.Conn, greeting string, replies map[string][]string) {
+    r := bufio.NewReader(conn)
+    conn.Write([]byte(greeting + "\n"))
+    for {
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+	    return
+	}
+	var req struct {
+	    Execute string `json:"execute"`
+	}
+	if err := json.Unmarshal(line, &req); err != nil {
+	    t.Errorf("bad request %q", line)
+	    return
+	}
+	for _, reply := range replies[req.Execute] {
+	    conn.Write([]byte(reply + "\n"))
+	}
+    }
+}
+
+const greeting = `{"QMP": {"version": {"qemu": {"micro": 0, "minor": 2, "major": 8}}, "capabilities": []}}`
+
+func TestMonitor(t *testing.T) {
+    near, far := net.Pipe()
+    defer near.Close()
+    go fakeQemu(t, far, greeting, map[string][]string{
+	"qmp_capabilities": { `{"return": {}}` },
+	"query-status": {
+	    `{"event": "RESUME", "timestamp": {"seconds": 1, "microseconds": 2}}`,
+	    `{"return": {"status": "running", "running": true}}`,
+	},
+	"human-monitor-command": { `{"return": "usernet\r\n"}` },
+	"system_powerdown": { `{"error": {"class": "GenericError", "desc": "no acpi"}}` },
+    })
+    m, err := newMonitor(near, time.Second)
+    if err != nil {
+	t.Fatal(err)
+    }
+    var status struct {
+	Status string `json:"status"`
+    }
+    if err := m.Execute("query-status", nil, &status); err != nil || status.Status != "running" {
+	t.Errorf("query-status %v %v", status, err)
+    }
+    if out, err := m.HumanMonitorCommand("info usernet"); err != nil || out != "usernet\r\n" {
+	t.Errorf("hmp %q %v", out, err)
+    }
+    if err := m.Powerdown(); err == nil || err.Error() != "qmp: system_powerdown GenericError: no acpi" {
+	t.Errorf("powerdown %v", err)
+    }
+}
+
+func TestMonitorGreeting(t *testing.T) {
+    near, far := net.Pipe()
+    defer near.Close()
+    go fakeQemu(t, far, `{"event": "SHUTDOWN"}`, nil)
+    if _, err := newMonitor(near, time.Second); err == nil || err.Error() != "qmp: bad greeting" {
+	t.Errorf("greeting %v", err)
+    }
+}
+
+func TestMonitorTimeout(t *testing.T) {
+    near, far := net.Pipe()
+    defer near.Close()
+    // a wedged qemu reads the commands and never answers
+    go fakeQemu(t, far, greeting, map[string][]string{
+	"qmp_capabilities": { `{"return": {}}` },
+    })
+    m, err := newMonitor(near, 100 * time.Millisecond)
+    if err != nil {
+	t.Fatal(err)
+    }
+    start := time.Now()
+    err = m.Powerdown()
+    if err == nil || !strings.Contains(err.Error(), "timeout") {
+	t.Errorf("powerdown %v", err)
+    }
+    if time.Since(start) > time.Second {
+	t.Errorf("took %v", time.Since(start))
+    }
+}
@@ -0,0 +1,159 @@
+// vm / ready.go
+//
+// MIT License Copyright(c) 2021 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+//
+package main
+
+import (
+    "fmt"
+    "net"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "time"
+
+    "vm/proc"
+    "vm/qemu"
+    "vm/qga"
+)
+
+const pollInterval = 500 * time.Millisecond
+
+// getVMByDir finds the running VM launched from dir
+func getVMByDir(dir string) *proc.VM {
+    for _, vm := range proc.GetVMs() {
+	if vm.VM_dir == dir {
+	    return &vm
+	}
+    }
+    return nil
+}
+
+// waitName waits until qemu named name is running
+func waitName(name string, timeout time.Duration) (*proc.VM, error) {
+    deadline := time.Now().Add(timeout)
+    for {
+	if vm := proc.GetVM(name); vm != nil {
+	    return vm, nil
+	}
+	if time.Now().After(deadline) {
+	    return nil, fmt.Errorf("wait: no vm %s", name)
+	}
+	time.Sleep(pollInterval)
+    }
+}
+
+// waitPid waits until qemu for dir is running
+func waitPid(dir string, timeout time.Duration) (*proc.VM, error) {
+    deadline := time.Now().Add(timeout)
+    for {
+	if vm := getVMByDir(dir); vm != nil {
+	    return vm, nil
+	}
+	if time.Now().After(deadline) {
+	    return nil, fmt.Errorf("wait: no qemu for %s", dir)
+	}
+	time.Sleep(pollInterval)
+    }
+}
+
+// waitPort waits until addr accepts connections and, if banner is set,
+// sends a first line starting with it. slirp accepts forwarded ports
+// before the guest listens, so only the banner tells the guest is up.
+func waitPort(addr, banner string, timeout time.Duration) error {
+    deadline := time.Now().Add(timeout)
+    for {
+	err := probePort(addr, banner)
+	if err == nil {
+	    return nil
+	}
+	if time.Now().After(deadline) {
+	    return fmt.Errorf("wait: %s %v", addr, err)
+	}
+	time.Sleep(pollInterval)
+    }
+}
+
+func probePort(addr, banner string) error {
+    conn, err := net.DialTimeout("tcp", addr, 2 * time.Second)
+    if err != nil {
+	return err
+    }
+    defer conn.Close()
+    if banner == "" {
+	return nil
+    }
+    conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+    buf := make([]byte, 256)
+    n, err := conn.Read(buf)
+    if err != nil {
+	return err
+    }
+    if !strings.HasPrefix(string(buf[:n]), banner) {
+	return fmt.Errorf("unexpected banner %q", string(buf[:n]))
+    }
+    return nil
+}
+
+// waitAgent waits until the guest agent answers guest-ping
+func waitAgent(path string, timeout time.Duration) error {
+    deadline := time.Now().Add(timeout)
+    for {
+	err := probeAgent(path)
+	if err == nil {
+	    return nil
+	}
+	if time.Now().After(deadline) {
+	    return fmt.Errorf("wait: agent %v", err)
+	}
+	time.Sleep(pollInterval)
+    }
+}
+
+func probeAgent(path string) error {
+    agent, err := qga.Dial(path, 2 * time.Second)
+    if err != nil {
+	return err
+    }
+    defer agent.Close()
+    return agent.Ping()
+}
+
+func wait(opts []string) {
+    flags, opts := cmdflags(opts, "port", "timeout")
+    timeout, err := seconds(flags, "timeout", 300)
+    if err != nil {
+	fmt.Printf("wait: %v\n", err)
+    }
+    if len(opts) == 0 || err != nil {
+	fmt.Println("vm wait <name> [--ssh|--port N|--agent] [--timeout seconds]")
+	os.Exit(1)
+    }
+    deadline := time.Now().Add(time.Duration(timeout) * time.Second)
+    vm, err := waitName(opts[0], time.Until(deadline))
+    if err != nil {
+	fmt.Printf("%v\n", err)
+	os.Exit(1)
+    }
+    switch {
+    case hasflag(flags, "agent"):
+	err = waitAgent(filepath.Join(vm.VM_dir, qemu.GuestAgentSocket), time.Until(deadline))
+    case hasflag(flags, "port"):
+	port, perr := strconv.Atoi(flags["port"])
+	if perr != nil {
+	    fmt.Printf("wait: bad port %q\n", flags["port"])
+	    os.Exit(1)
+	}
+	err = waitPort(fmt.Sprintf("%s:%d", vm.VM_local_net, port), "", time.Until(deadline))
+    default:
+	addr, port := sshAddr(vm)
+	err = waitPort(fmt.Sprintf("%s:%d", addr, port), "SSH-", time.Until(deadline))
+    }
+    if err != nil {
+	fmt.Printf("%v\n", err)
+	os.Exit(1)
+    }
+    fmt.Printf("%s is ready\n", vm.Name)
+}
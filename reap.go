@@ -0,0 +1,67 @@
+// vm / reap.go
+//
+// MIT License Copyright(c) 2021 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+//
+package main
+
+import (
+    "fmt"
+    "os"
+    "os/exec"
+    "reflect"
+    "strconv"
+    "syscall"
+    "time"
+
+    "vm/cgroup"
+    "vm/proc"
+    "vm/qemu"
+)
+
+// watchQemu leaves a reaper behind the daemonized qemu, the helpers are
+// stopped and the cgroup is removed when qemu exits, a poweroff in the guest too
+func watchQemu(vm *qemu.VMConfig, pid int, g *cgroup.Group) {
+    if len(vm.Helpers()) == 0 && g == nil {
+	return
+    }
+    self, err := os.Executable()
+    if err != nil {
+	fmt.Printf("reap: %v\n", err)
+	return
+    }
+    args := []string{ "reap", strconv.Itoa(pid) }
+    if g != nil {
+	args = append(args, "--cgroup=" + g.Path)
+    }
+    cmd := exec.Command(self, args...)
+    cmd.Dir = vm.Dir
+    cmd.SysProcAttr = &syscall.SysProcAttr{ Setsid: true }
+    if err := cmd.Start(); err != nil {
+	fmt.Printf("reap: %v\n", err)
+	return
+    }
+    cmd.Process.Release()
+}
+
+// reap <qemu pid> [--cgroup=path] runs in the VM directory until qemu exits
+func reap(opts []string) {
+    flags, opts := cmdflags(opts)
+    if len(opts) == 0 {
+	os.Exit(1)
+    }
+    pid, err := strconv.Atoi(opts[0])
+    if err != nil {
+	os.Exit(1)
+    }
+    cwd, _ := os.Getwd()
+    // the pid may be reused, the command line tells it is qemu still
+    cmdline := proc.Procread(pid, "cmdline")
+    for proc.Alive(pid) && reflect.DeepEqual(proc.Procread(pid, "cmdline"), cmdline) {
+	time.Sleep(time.Second)
+    }
+    qemu.StopHelpers(cwd)
+    if path := flags["cgroup"]; path != "" {
+	removeCgroup(&cgroup.Group{ Path: path })
+    }
+}
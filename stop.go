@@ -0,0 +1,79 @@
+// vm / stop.go
+//
+// MIT License Copyright(c) 2021 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+//
+package main
+
+import (
+    "fmt"
+    "os"
+    "path/filepath"
+    "syscall"
+    "time"
+
+    "vm/proc"
+    "vm/qemu"
+    "vm/qmp"
+)
+
+func waitexit(pid int, timeout time.Duration) bool {
+    deadline := time.Now().Add(timeout)
+    for time.Now().Before(deadline) {
+	if !proc.Alive(pid) {
+	    return true
+	}
+	time.Sleep(200 * time.Millisecond)
+    }
+    return !proc.Alive(pid)
+}
+
+// stopVM unplugs the VM from its switches, asks the guest to power off
+// and terminates qemu after timeout, the helpers go away with it
+func stopVM(vm *proc.VM, timeout time.Duration) error {
+    defer qemu.StopHelpers(vm.VM_dir)
+    // before the switch starts redialing
+    unplugVM(vm)
+    sock := filepath.Join(vm.VM_dir, qemu.QMPSocket)
+    if m, err := qmp.Dial(sock, 5 * time.Second); err == nil {
+	fmt.Printf("powerdown %s\n", vm.Name)
+	if err := m.Powerdown(); err != nil {
+	    fmt.Printf("powerdown: %v\n", err)
+	}
+	m.Close()
+	if waitexit(vm.Pid, timeout) {
+	    return nil
+	}
+	fmt.Printf("%s did not power off in %v\n", vm.Name, timeout)
+    } else {
+	fmt.Printf("monitor: %v\n", err)
+    }
+    fmt.Printf("terminate %d\n", vm.Pid)
+    syscall.Kill(vm.Pid, syscall.SIGTERM)
+    if waitexit(vm.Pid, 10 * time.Second) {
+	return nil
+    }
+    syscall.Kill(vm.Pid, syscall.SIGKILL)
+    return fmt.Errorf("stop: %s killed", vm.Name)
+}
+
+func stop(opts []string) {
+    flags, opts := cmdflags(opts, "timeout")
+    timeout, err := seconds(flags, "timeout", 60)
+    if err != nil {
+	fmt.Printf("stop: %v\n", err)
+    }
+    if len(opts) == 0 || err != nil {
+	fmt.Println("vm stop [--timeout=seconds] <name>")
+	os.Exit(1)
+    }
+    vm := proc.GetVM(opts[0])
+    if vm == nil {
+	fmt.Printf("no vm %s\n", opts[0])
+	os.Exit(1)
+    }
+    if err := stopVM(vm, time.Duration(timeout) * time.Second); err != nil {
+	fmt.Printf("%v\n", err)
+	os.Exit(1)
+    }
+}
@@ -0,0 +1,67 @@
+// vm / supervise.go
+//
+// MIT License Copyright(c) 2021 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+//
+package main
+
+import (
+    "fmt"
+    "os"
+    "os/exec"
+    "os/signal"
+    "syscall"
+)
+
+// supervise runs cmd as our child with the output streamed, forwards the
+// signals we get to it and returns its exit status like a shell does.
+// started is called with the pid once the child is running.
+func supervise(cmd *exec.Cmd, started func(pid int)) int {
+    cmd.Stdin = os.Stdin
+    cmd.Stdout = os.Stdout
+    cmd.Stderr = os.Stderr
+
+    sigs := make(chan os.Signal, 8)
+    signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP,
+	    syscall.SIGQUIT, syscall.SIGUSR1, syscall.SIGUSR2)
+    defer signal.Stop(sigs)
+
+    if err := cmd.Start(); err != nil {
+	fmt.Printf("Start %v\n", err)
+	return 1
+    }
+    if started != nil {
+	started(cmd.Process.Pid)
+    }
+    done := make(chan error, 1)
+    go func() {
+	done <- cmd.Wait()
+    }()
+    for {
+	select {
+	case sig := <-sigs:
+	    fmt.Printf("forward %v to %d\n", sig, cmd.Process.Pid)
+	    cmd.Process.Signal(sig)
+	case err := <-done:
+	    return exitcode(cmd, err)
+	}
+    }
+}
+
+func exitcode(cmd *exec.Cmd, err error) int {
+    if err == nil {
+	return 0
+    }
+    if _, ok := err.(*exec.ExitError); !ok {
+	fmt.Printf("Wait %v\n", err)
+	return 1
+    }
+    status, ok := cmd.ProcessState.Sys().(syscall.WaitStatus)
+    if !ok {
+	return 1
+    }
+    if status.Signaled() {
+	return 128 + int(status.Signal())
+    }
+    return status.ExitStatus()
+}
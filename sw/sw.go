@@ -0,0 +1,112 @@
+// vm/sw
+//
+// MIT License Copyright(c) 2021 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+//
+package sw
+
+// The control protocol of tools/sw, one JSON request and one JSON
+// response over a connection to the unix socket of the switch.
+
+import (
+    "encoding/json"
+    "fmt"
+    "net"
+    "time"
+)
+
+// SockPath is the control socket of the switch name
+func SockPath(name string) string {
+    return fmt.Sprintf("/tmp/vm-sw-%s.sock", name)
+}
+
+// Request commands
+const (
+    Connect = "connect"
+    Disconnect = "disconnect"
+    ListPorts = "list-ports"
+    ShowMACTable = "show-mac-table"
+    Stats = "stats"
+    Capture = "capture"
+    CaptureStop = "capture-stop"
+    SetPort = "set-port"
+    ShowConfig = "show-config"
+)
+
+type Request struct {
+    Command string `json:"command"`
+    // Port names the port, connect uses Addr when it is empty
+    Port string `json:"port,omitempty"`
+    // Addr is where connect dials
+    Addr string `json:"addr,omitempty"`
+    // File is the pcap file of capture, Port may be all
+    File string `json:"file,omitempty"`
+    Filter string `json:"filter,omitempty"`
+    // Settings are the key=value of set-port
+    Settings []string `json:"settings,omitempty"`
+}
+
+type PortInfo struct {
+    Name string `json:"name"`
+    Remote string `json:"remote"`
+    // State is up, or reconnecting for a lost dialed port
+    State string `json:"state"`
+}
+
+type MACEntry struct {
+    VLAN int `json:"vlan"`
+    MAC string `json:"mac"`
+    Port string `json:"port"`
+    // Age is the seconds since the MAC was seen
+    Age int `json:"age"`
+}
+
+type PortStats struct {
+    Name string `json:"name"`
+    RxFrames uint64 `json:"rx_frames"`
+    RxBytes uint64 `json:"rx_bytes"`
+    TxFrames uint64 `json:"tx_frames"`
+    TxBytes uint64 `json:"tx_bytes"`
+    // Drops counts the frames the port queue had no room for
+    Drops uint64 `json:"drops"`
+}
+
+type SwitchStats struct {
+    Forwarded uint64 `json:"forwarded"`
+    Flooded uint64 `json:"flooded"`
+    Filtered uint64 `json:"filtered"`
+    Ports []PortStats `json:"ports"`
+}
+
+type Response struct {
+    Error string `json:"error,omitempty"`
+    Ports []PortInfo `json:"ports,omitempty"`
+    Table []MACEntry `json:"table,omitempty"`
+    Stats *SwitchStats `json:"stats,omitempty"`
+    // Frames is how many frames capture-stop has written
+    Frames uint64 `json:"frames,omitempty"`
+    // Configs are the port settings by port name
+    Configs map[string]PortConfig `json:"configs,omitempty"`
+}
+
+// Call sends req to the switch name and returns its response,
+// the error of the switch is returned as an error too
+func Call(name string, req *Request, timeout time.Duration) (*Response, error) {
+    conn, err := net.DialTimeout("unix", SockPath(name), timeout)
+    if err != nil {
+	return nil, err
+    }
+    defer conn.Close()
+    conn.SetDeadline(time.Now().Add(timeout))
+    if err := json.NewEncoder(conn).Encode(req); err != nil {
+	return nil, err
+    }
+    resp := &Response{}
+    if err := json.NewDecoder(conn).Decode(resp); err != nil {
+	return nil, err
+    }
+    if resp.Error != "" {
+	return resp, fmt.Errorf("%s", resp.Error)
+    }
+    return resp, nil
+}
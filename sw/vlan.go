@@ -0,0 +1,155 @@
+// vm/sw / vlan.go
+//
+// MIT License Copyright(c) 2021 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+//
+package sw
+
+import (
+    "fmt"
+    "sort"
+    "strconv"
+    "strings"
+)
+
+// PortConfig is the VLAN and isolation setting of a switch port.
+// An access port carries VLAN untagged, a trunk carries the Allowed
+// VLANs tagged and Native untagged. Isolated ports talk to uplinks only.
+type PortConfig struct {
+    Mode string `json:"mode"`
+    VLAN int `json:"vlan,omitempty"`
+    // Allowed is empty for all VLANs
+    Allowed []int `json:"allowed,omitempty"`
+    // Native 0 drops untagged frames on a trunk
+    Native int `json:"native"`
+    Isolated bool `json:"isolated,omitempty"`
+    Uplink bool `json:"uplink,omitempty"`
+}
+
+// DefaultPortConfig passes every VLAN through and puts untagged frames in 1,
+// that is a switch without VLAN setting
+func DefaultPortConfig() PortConfig {
+    return PortConfig{ Mode: "trunk", Native: 1 }
+}
+
+func parseVID(s string) (int, error) {
+    vid, err := strconv.Atoi(s)
+    if err != nil || vid < 1 || vid > 4094 {
+	return 0, fmt.Errorf("bad vlan %q", s)
+    }
+    return vid, nil
+}
+
+func onoff(s string) (bool, error) {
+    switch s {
+    case "on", "1", "yes": return true, nil
+    case "off", "0", "no": return false, nil
+    }
+    return false, fmt.Errorf("bad switch %q", s)
+}
+
+// Set applies one key=value,
+// mode=access|trunk vlan=N allowed=all|N,N,.. native=N|none isolated=on|off uplink=on|off
+func (c *PortConfig)Set(kv string) error {
+    a := strings.SplitN(kv, "=", 2)
+    if len(a) != 2 {
+	return fmt.Errorf("bad setting %q", kv)
+    }
+    key, val := a[0], a[1]
+    var err error
+    switch key {
+    case "mode":
+	if val != "access" && val != "trunk" {
+	    return fmt.Errorf("bad mode %q", val)
+	}
+	c.Mode = val
+    case "vlan":
+	c.VLAN, err = parseVID(val)
+    case "allowed":
+	c.Allowed = nil
+	if val == "all" {
+	    break
+	}
+	for _, s := range strings.Split(val, ",") {
+	    vid, err := parseVID(s)
+	    if err != nil {
+		return err
+	    }
+	    c.Allowed = append(c.Allowed, vid)
+	}
+	sort.Ints(c.Allowed)
+    case "native":
+	if val == "none" {
+	    c.Native = 0
+	    break
+	}
+	c.Native, err = parseVID(val)
+    case "isolated":
+	c.Isolated, err = onoff(val)
+    case "uplink":
+	c.Uplink, err = onoff(val)
+    default:
+	return fmt.Errorf("unknown setting %q", key)
+    }
+    return err
+}
+
+// AccessVLAN is the VLAN of an access port, 1 unless set
+func (c *PortConfig)AccessVLAN() int {
+    if c.VLAN == 0 {
+	return 1
+    }
+    return c.VLAN
+}
+
+// Allows tells whether a trunk carries vid, the native VLAN always
+func (c *PortConfig)Allows(vid int) bool {
+    if len(c.Allowed) == 0 || vid == c.Native {
+	return true
+    }
+    for _, v := range c.Allowed {
+	if v == vid {
+	    return true
+	}
+    }
+    return false
+}
+
+// Reaches tells whether a frame from a port with c may go out to one with out
+func (c *PortConfig)Reaches(out *PortConfig) bool {
+    if c.Isolated && !out.Uplink {
+	return false
+    }
+    if out.Isolated && !c.Uplink {
+	return false
+    }
+    return true
+}
+
+func (c PortConfig)String() string {
+    s := ""
+    if c.Mode == "access" {
+	s = fmt.Sprintf("access vlan %d", c.AccessVLAN())
+    } else {
+	allowed := "all"
+	if len(c.Allowed) > 0 {
+	    a := []string{}
+	    for _, v := range c.Allowed {
+		a = append(a, strconv.Itoa(v))
+	    }
+	    allowed = strings.Join(a, ",")
+	}
+	native := "none"
+	if c.Native != 0 {
+	    native = strconv.Itoa(c.Native)
+	}
+	s = fmt.Sprintf("trunk allowed %s native %s", allowed, native)
+    }
+    if c.Isolated {
+	s += " isolated"
+    }
+    if c.Uplink {
+	s += " uplink"
+    }
+    return s
+}
@@ -0,0 +1,54 @@
+// vm / switch.go
+//
+// MIT License Copyright(c) 2021 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+//
+package main
+
+import (
+    "fmt"
+    "time"
+
+    "vm/proc"
+    "vm/qemu"
+    "vm/sw"
+)
+
+// plugSwitches asks the switches to connect to the socket netdevs,
+// qemu may take a while before it listens
+func plugSwitches(vm *qemu.VMConfig) {
+    for _, p := range vm.SwitchPorts() {
+	req := &sw.Request{ Command: sw.Connect, Port: p.Port, Addr: p.Addr }
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+	    _, err := sw.Call(p.Switch, req, 5 * time.Second)
+	    if err == nil {
+		fmt.Printf("switch %s: port %s connected to %s\n", p.Switch, p.Port, p.Addr)
+		break
+	    }
+	    if time.Now().After(deadline) {
+		fmt.Printf("switch %s: %v\n", p.Switch, err)
+		break
+	    }
+	    time.Sleep(500 * time.Millisecond)
+	}
+    }
+}
+
+// unplugSwitches removes the ports of a VM going away
+func unplugSwitches(ports []qemu.SwitchPort) {
+    for _, p := range ports {
+	req := &sw.Request{ Command: sw.Disconnect, Port: p.Port }
+	if _, err := sw.Call(p.Switch, req, 5 * time.Second); err != nil {
+	    fmt.Printf("switch %s: %v\n", p.Switch, err)
+	    continue
+	}
+	fmt.Printf("switch %s: port %s disconnected\n", p.Switch, p.Port)
+    }
+}
+
+func unplugVM(vm *proc.VM) {
+    if vm.VM_switches != "" {
+	unplugSwitches(qemu.ParseSwitchEnv(vm.VM_switches))
+    }
+}
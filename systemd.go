@@ -0,0 +1,244 @@
+// vm / systemd.go
+//
+// MIT License Copyright(c) 2021 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+//
+package main
+
+import (
+    "fmt"
+    "io/ioutil"
+    "os"
+    "os/exec"
+    "path/filepath"
+    "strings"
+
+    "vm/proc"
+    "vm/qemu"
+)
+
+// vmdir finds the directory of a VM given as a directory or a VM name.
+// A name is looked up in the running VMs, the installed units and
+// the directories in $VM_PATH, ~/vm by default, so it needs not run.
+func vmdir(arg string) (string, error) {
+    if arg == "" {
+	return os.Getwd()
+    }
+    if info, err := os.Stat(arg); err == nil && info.IsDir() {
+	return filepath.Abs(arg)
+    }
+    if vm := proc.GetVM(arg); vm != nil {
+	return vm.VM_dir, nil
+    }
+    if dir := unitWorkDir(arg); dir != "" {
+	return dir, nil
+    }
+    for _, root := range vmPath() {
+	dirs, _ := filepath.Glob(filepath.Join(root, "*"))
+	for _, dir := range dirs {
+	    if configName(dir) == arg {
+		return dir, nil
+	    }
+	}
+    }
+    return "", fmt.Errorf("no vm %s", arg)
+}
+
+func vmPath() []string {
+    if val, ok := os.LookupEnv("VM_PATH"); ok && val != "" {
+	return filepath.SplitList(val)
+    }
+    home, _ := os.UserHomeDir()
+    return []string{ filepath.Join(home, "vm") }
+}
+
+// configName is the name in dir/config, the directory name without one
+func configName(dir string) string {
+    data, err := ioutil.ReadFile(filepath.Join(dir, "config"))
+    if err != nil {
+	return ""
+    }
+    name := filepath.Base(dir)
+    for _, line := range strings.Split(string(data), "\n") {
+	if line == "" || line[0] == '#' {
+	    continue
+	}
+	if key, val := keyval(line); key == "name" && val != "" {
+	    name = val
+	}
+    }
+    return name
+}
+
+func unitName(name string) string {
+    return "vm-" + name + ".service"
+}
+
+func unitDir() string {
+    if dir, ok := os.LookupEnv("XDG_CONFIG_HOME"); ok && dir != "" {
+	return filepath.Join(dir, "systemd", "user")
+    }
+    home, _ := os.UserHomeDir()
+    return filepath.Join(home, ".config", "systemd", "user")
+}
+
+// unitWorkDir reads WorkingDirectory of the installed unit of name
+func unitWorkDir(name string) string {
+    data, err := ioutil.ReadFile(filepath.Join(unitDir(), unitName(name)))
+    if err != nil {
+	return ""
+    }
+    for _, line := range strings.Split(string(data), "\n") {
+	if strings.HasPrefix(line, "WorkingDirectory=") {
+	    return strings.Replace(line[17:], "%%", "%", -1)
+	}
+    }
+    return ""
+}
+
+// specifiers escapes % which systemd expands everywhere in a unit
+func specifiers(s string) string {
+    return strings.Replace(s, "%", "%%", -1)
+}
+
+// execQuote quotes a word of ExecStart and the like
+func execQuote(s string) string {
+    s = strings.Replace(s, "\\", "\\\\", -1)
+    s = strings.Replace(s, "\"", "\\\"", -1)
+    s = strings.Replace(s, "$", "$$", -1)
+    return "\"" + specifiers(s) + "\""
+}
+
+func unit(exe, dir, name string, timeout int) string {
+    lines := []string{
+	"[Unit]",
+	"Description=vm " + specifiers(name),
+	"After=network-online.target",
+	"",
+	"[Service]",
+	"Type=simple",
+	"WorkingDirectory=" + specifiers(dir),
+	"ExecStart=" + execQuote(exe) + " launch --foreground",
+	fmt.Sprintf("ExecStop=%s stop --timeout=%d %s", execQuote(exe), timeout, execQuote(name)),
+	fmt.Sprintf("TimeoutStopSec=%d", timeout + 30),
+	"KillMode=mixed",
+	"Restart=on-failure",
+	"",
+	"[Install]",
+	"WantedBy=default.target",
+    }
+    return strings.Join(lines, "\n") + "\n"
+}
+
+func systemctl(args ...string) error {
+    cmd := exec.Command("systemctl", append([]string{"--user"}, args...)...)
+    cmd.Stdout = os.Stdout
+    cmd.Stderr = os.Stderr
+    return cmd.Run()
+}
+
+// vmUnit returns the name and the unit of the VM in dir
+func vmUnit(dir string, timeout int) (string, string, error) {
+    vm, err := qemu.FromConfig(dir, filepath.Join(dir, "config"), nil)
+    if err != nil {
+	return "", "", err
+    }
+    exe, err := os.Executable()
+    if err != nil {
+	return "", "", err
+    }
+    return vm.Name, unit(exe, dir, vm.Name, timeout), nil
+}
+
+func installUnit(name, text string) error {
+    udir := unitDir()
+    if err := os.MkdirAll(udir, 0755); err != nil {
+	return err
+    }
+    path := filepath.Join(udir, unitName(name))
+    if err := ioutil.WriteFile(path, []byte(text), 0644); err != nil {
+	return err
+    }
+    fmt.Printf("installed %s\n", path)
+    if err := systemctl("daemon-reload"); err != nil {
+	return fmt.Errorf("daemon-reload: %v", err)
+    }
+    return nil
+}
+
+func systemd(opts []string) {
+    flags, opts := cmdflags(opts, "timeout")
+    timeout, err := seconds(flags, "timeout", 60)
+    if err != nil {
+	fmt.Printf("systemd: %v\n", err)
+	fmt.Println("vm systemd [--install] [--timeout=seconds] [name|dir]")
+	os.Exit(1)
+    }
+    arg := ""
+    if len(opts) > 0 {
+	arg = opts[0]
+    }
+    dir, err := vmdir(arg)
+    if err != nil {
+	fmt.Printf("%v\n", err)
+	os.Exit(1)
+    }
+    name, text, err := vmUnit(dir, timeout)
+    if err != nil {
+	fmt.Printf("%v\n", err)
+	os.Exit(1)
+    }
+    if !hasflag(flags, "install") {
+	fmt.Print(text)
+	return
+    }
+    if err := installUnit(name, text); err != nil {
+	fmt.Printf("%v\n", err)
+	os.Exit(1)
+    }
+}
+
+// autostart enables or disables the unit of the VM named opts[0]
+func autostart(opts []string, enable bool) {
+    if len(opts) == 0 {
+	fmt.Println("vm <enable|disable> <name>")
+	os.Exit(1)
+    }
+    name := opts[0]
+    if info, err := os.Stat(name); err == nil && info.IsDir() {
+	dir, _ := filepath.Abs(name)
+	vm, err := qemu.FromConfig(dir, filepath.Join(dir, "config"), nil)
+	if err != nil {
+	    os.Exit(1)
+	}
+	name = vm.Name
+    }
+    // enabling a VM without its unit installs it first
+    if _, err := os.Stat(filepath.Join(unitDir(), unitName(name))); err != nil && enable {
+	dir, err := vmdir(opts[0])
+	if err != nil {
+	    fmt.Printf("%v\n", err)
+	    os.Exit(1)
+	}
+	n, text, err := vmUnit(dir, 60)
+	if err == nil {
+	    name = n
+	    err = installUnit(name, text)
+	}
+	if err != nil {
+	    fmt.Printf("%v\n", err)
+	    os.Exit(1)
+	}
+    }
+    op := "disable"
+    if enable {
+	op = "enable"
+    }
+    if err := systemctl(op, unitName(name)); err != nil {
+	fmt.Printf("%s: %v\n", op, err)
+	os.Exit(1)
+    }
+    if enable {
+	fmt.Println("to start it at boot without login: loginctl enable-linger")
+    }
+}
@@ -0,0 +1,233 @@
+// tools/sw / capture.go
+//
+// MIT License Copyright(c) 2021 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+//
+package main
+
+import (
+    "bufio"
+    "encoding/binary"
+    "fmt"
+    "io"
+    "net"
+    "os"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// Filter is a small part of the tcpdump language, terms joined by and
+//   arp | ip | ip6 | vlan | ether proto N | ether host|src|dst MAC
+type Filter struct {
+    EtherType int // -1 for any
+    Host, Src, Dst *MAC
+}
+
+var etherTypes = map[string]int{
+    "ip": 0x0800,
+    "arp": 0x0806,
+    "vlan": 0x8100,
+    "ip6": 0x86dd,
+}
+
+func parseMAC(s string) (*MAC, error) {
+    hw, err := net.ParseMAC(s)
+    if err != nil || len(hw) != 6 {
+	return nil, fmt.Errorf("bad mac %q", s)
+    }
+    var m MAC
+    copy(m[:], hw)
+    return &m, nil
+}
+
+func ParseFilter(expr string) (*Filter, error) {
+    f := &Filter{ EtherType: -1 }
+    w := strings.Fields(expr)
+    for i := 0; i < len(w); i++ {
+	if t, ok := etherTypes[w[i]]; ok {
+	    f.EtherType = t
+	    continue
+	}
+	switch w[i] {
+	case "and":
+	    continue
+	case "ether":
+	    if i + 2 >= len(w) {
+		return nil, fmt.Errorf("filter: ether needs proto, host, src or dst and a value")
+	    }
+	    what, val := w[i + 1], w[i + 2]
+	    i += 2
+	    var err error
+	    switch what {
+	    case "proto":
+		var n uint64
+		n, err = strconv.ParseUint(val, 0, 16)
+		f.EtherType = int(n)
+	    case "host": f.Host, err = parseMAC(val)
+	    case "src": f.Src, err = parseMAC(val)
+	    case "dst": f.Dst, err = parseMAC(val)
+	    default:
+		return nil, fmt.Errorf("filter: unknown ether %s", what)
+	    }
+	    if err != nil {
+		return nil, fmt.Errorf("filter: %v", err)
+	    }
+	default:
+	    return nil, fmt.Errorf("filter: unknown %q", w[i])
+	}
+    }
+    return f, nil
+}
+
+func (f *Filter)Match(frame []byte) bool {
+    if len(frame) < 14 {
+	return false
+    }
+    var dst, src MAC
+    copy(dst[:], frame[0:6])
+    copy(src[:], frame[6:12])
+    if f.EtherType >= 0 && int(binary.BigEndian.Uint16(frame[12:14])) != f.EtherType {
+	return false
+    }
+    if f.Host != nil && *f.Host != dst && *f.Host != src {
+	return false
+    }
+    if f.Src != nil && *f.Src != src {
+	return false
+    }
+    if f.Dst != nil && *f.Dst != dst {
+	return false
+    }
+    return true
+}
+
+// pcap file format, microsecond timestamps and ethernet frames
+const (
+    pcapMagic = 0xa1b2c3d4
+    pcapSnaplen = 65535
+    linktypeEthernet = 1
+)
+
+// Capture writes the frames of a port, or all ports, to a pcap file
+type Capture struct {
+    Port string
+    File string
+    filter *Filter
+    mu sync.Mutex
+    f *os.File
+    w *bufio.Writer
+    frames uint64
+}
+
+func NewCapture(port, file, filter string) (*Capture, error) {
+    flt, err := ParseFilter(filter)
+    if err != nil {
+	return nil, err
+    }
+    f, err := os.Create(file)
+    if err != nil {
+	return nil, err
+    }
+    c := &Capture{ Port: port, File: file, filter: flt, f: f, w: bufio.NewWriter(f) }
+    hdr := make([]byte, 24)
+    binary.LittleEndian.PutUint32(hdr[0:], pcapMagic)
+    binary.LittleEndian.PutUint16(hdr[4:], 2)
+    binary.LittleEndian.PutUint16(hdr[6:], 4)
+    binary.LittleEndian.PutUint32(hdr[16:], pcapSnaplen)
+    binary.LittleEndian.PutUint32(hdr[20:], linktypeEthernet)
+    c.w.Write(hdr)
+    return c, nil
+}
+
+func writeRecord(w io.Writer, ts time.Time, frame []byte) {
+    n := len(frame)
+    if n > pcapSnaplen {
+	n = pcapSnaplen
+    }
+    hdr := make([]byte, 16)
+    binary.LittleEndian.PutUint32(hdr[0:], uint32(ts.Unix()))
+    binary.LittleEndian.PutUint32(hdr[4:], uint32(ts.Nanosecond() / 1000))
+    binary.LittleEndian.PutUint32(hdr[8:], uint32(n))
+    binary.LittleEndian.PutUint32(hdr[12:], uint32(len(frame)))
+    w.Write(hdr)
+    w.Write(frame[:n])
+}
+
+func (c *Capture)write(ts time.Time, frame []byte) {
+    if !c.filter.Match(frame) {
+	return
+    }
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if c.w == nil {
+	return
+    }
+    writeRecord(c.w, ts, frame)
+    c.frames++
+}
+
+// Close flushes the file and returns the number of frames written
+func (c *Capture)Close() (uint64, error) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if c.w == nil {
+	return c.frames, nil
+    }
+    err := c.w.Flush()
+    if cerr := c.f.Close(); err == nil {
+	err = cerr
+    }
+    c.w = nil
+    return c.frames, err
+}
+
+// StartCapture captures port, or every frame entering the switch with all
+func (sw *Switch)StartCapture(port, file, filter string) error {
+    sw.capMu.Lock()
+    defer sw.capMu.Unlock()
+    for _, c := range sw.captures {
+	if c.File == file {
+	    return fmt.Errorf("%s is being captured", file)
+	}
+    }
+    c, err := NewCapture(port, file, filter)
+    if err != nil {
+	return err
+    }
+    sw.captures = append(sw.captures, c)
+    sw.Logf("capture %s to %s", port, file)
+    return nil
+}
+
+func (sw *Switch)StopCapture(file string) (uint64, error) {
+    sw.capMu.Lock()
+    defer sw.capMu.Unlock()
+    for i, c := range sw.captures {
+	if c.File != file {
+	    continue
+	}
+	sw.captures = append(sw.captures[:i], sw.captures[i+1:]...)
+	n, err := c.Close()
+	sw.Logf("capture %s stopped, %d frames", file, n)
+	return n, err
+    }
+    return 0, fmt.Errorf("no capture %s", file)
+}
+
+// capture hands the frame to the captures, rx is the frame coming in
+// from port, the all captures see frames once, when they come in
+func (sw *Switch)capture(port string, rx bool, frame []byte) {
+    sw.capMu.Lock()
+    defer sw.capMu.Unlock()
+    if len(sw.captures) == 0 {
+	return
+    }
+    now := sw.now()
+    for _, c := range sw.captures {
+	if c.Port == port || (rx && c.Port == "all") {
+	    c.write(now, frame)
+	}
+    }
+}
@@ -0,0 +1,129 @@
+// tools/sw / capture_test.go
+//
+// MIT License Copyright(c) 2021 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+//
+package main
+
+import (
+    "bytes"
+    "encoding/binary"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "testing"
+)
+
+func typed(dst, src MAC, etype uint16) []byte {
+    f := frame(dst, src, "payload")
+    binary.BigEndian.PutUint16(f[12:], etype)
+    return f
+}
+
+func TestFilter(t *testing.T) {
+    arp := typed(bcast, macA, 0x0806)
+    ip := typed(macB, macA, 0x0800)
+    tests := []struct {
+	expr string
+	arp, ip bool
+    }{
+	{ "", true, true },
+	{ "arp", true, false },
+	{ "ip", false, true },
+	{ "ether proto 0x0806", true, false },
+	{ "ether host 52:54:00:00:00:0b", false, true },
+	{ "ether src 52:54:00:00:00:0a and arp", true, false },
+	{ "ether dst ff:ff:ff:ff:ff:ff", true, false },
+	{ "ip6", false, false },
+    }
+    for _, tt := range tests {
+	f, err := ParseFilter(tt.expr)
+	if err != nil {
+	    t.Errorf("%q: %v", tt.expr, err)
+	    continue
+	}
+	if f.Match(arp) != tt.arp || f.Match(ip) != tt.ip {
+	    t.Errorf("%q: arp %v ip %v", tt.expr, f.Match(arp), f.Match(ip))
+	}
+    }
+    for _, expr := range []string{ "tcp", "ether", "ether host 1:2", "ether proto 0x10000", "ether via x" } {
+	if _, err := ParseFilter(expr); err == nil {
+	    t.Errorf("%q: no error", expr)
+	}
+    }
+}
+
+// records reads a pcap file back
+func records(t *testing.T, path string) [][]byte {
+    data, err := ioutil.ReadFile(path)
+    if err != nil {
+	t.Fatal(err)
+    }
+    if len(data) < 24 || binary.LittleEndian.Uint32(data) != pcapMagic || binary.LittleEndian.Uint32(data[20:]) != linktypeEthernet {
+	t.Fatalf("%s: bad header %x", path, data)
+    }
+    frames := [][]byte{}
+    for data = data[24:]; len(data) >= 16; {
+	n := int(binary.LittleEndian.Uint32(data[8:]))
+	frames = append(frames, data[16:16+n])
+	data = data[16+n:]
+    }
+    return frames
+}
+
+func TestCapture(t *testing.T) {
+    dir, err := ioutil.TempDir("", "sw")
+    if err != nil {
+	t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+    sw := quiet(NewSwitch(), t)
+    a, b := plug(t, sw, "a"), plug(t, sw, "b")
+    all := filepath.Join(dir, "all.pcap")
+    portb := filepath.Join(dir, "b.pcap")
+    if err := sw.StartCapture("all", all, ""); err != nil {
+	t.Fatal(err)
+    }
+    if err := sw.StartCapture("b", portb, "arp"); err != nil {
+	t.Fatal(err)
+    }
+    if err := sw.StartCapture("a", portb, ""); err == nil {
+	t.Errorf("same file twice")
+    }
+    if err := sw.StartCapture("a", filepath.Join(dir, "x.pcap"), "tcp"); err == nil {
+	t.Errorf("bad filter")
+    }
+    arp := typed(bcast, macA, 0x0806)
+    ip := typed(macA, macB, 0x0800)
+    reply := typed(macA, macB, 0x0806)
+    a.send(t, arp)
+    b.expect(t, "b", arp)
+    b.send(t, ip)
+    a.expect(t, "a", ip)
+    b.send(t, reply)
+    a.expect(t, "a", reply)
+    n, err := sw.StopCapture(all)
+    if err != nil || n != 3 {
+	t.Errorf("all: %d %v", n, err)
+    }
+    // b saw the arp going out and the reply coming in
+    if n, err = sw.StopCapture(portb); err != nil || n != 2 {
+	t.Errorf("b: %d %v", n, err)
+    }
+    if _, err := sw.StopCapture(portb); err == nil {
+	t.Errorf("stopped twice")
+    }
+    want := [][]byte{ arp, ip, reply }
+    got := records(t, all)
+    if len(got) != len(want) {
+	t.Fatalf("all: %d frames", len(got))
+    }
+    for i := range want {
+	if !bytes.Equal(got[i], want[i]) {
+	    t.Errorf("all %d: %x", i, got[i])
+	}
+    }
+    if got := records(t, portb); len(got) != 2 || !bytes.Equal(got[0], arp) || !bytes.Equal(got[1], reply) {
+	t.Errorf("b: %x", got)
+    }
+}
@@ -0,0 +1,161 @@
+// tools/sw / link.go
+//
+// MIT License Copyright(c) 2021 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+//
+package main
+
+import (
+    "fmt"
+    "net"
+    "strings"
+    "sync/atomic"
+    "time"
+)
+
+// redial backoff
+var (
+    minBackoff = time.Second
+    maxBackoff = 30 * time.Second
+)
+
+const dialTimeout = 5 * time.Second
+
+// link is a port the switch dials, like a qemu -netdev socket,listen=
+type link struct {
+    addr string
+    stop chan struct{}
+}
+
+// Dial connects to addr as the port name and keeps it connected until
+// the port is removed.
+// Dialing a link again is fine, it stays as it is while up and is
+// replaced when it is down or goes to another address, the VM came back.
+func (sw *Switch)Dial(name, addr string) error {
+    conn, err := net.DialTimeout("tcp", addr, dialTimeout)
+    if err != nil {
+	return err
+    }
+    sw.mu.Lock()
+    old, linked := sw.links[name]
+    stale, up := sw.ports[name]
+    if linked && up && old.addr == addr {
+	sw.mu.Unlock()
+	conn.Close()
+	return nil
+    }
+    if linked && up {
+	sw.unplug(stale)
+    }
+    p, err := sw.plug(name, conn)
+    if err != nil {
+	sw.mu.Unlock()
+	conn.Close()
+	return err
+    }
+    if linked {
+	close(old.stop)
+    }
+    l := &link{ addr: addr, stop: make(chan struct{}) }
+    sw.links[name] = l
+    sw.mu.Unlock()
+    if linked {
+	if up {
+	    stale.close()
+	}
+	sw.Logf("port %s relinked to %s", name, addr)
+    }
+    sw.start(p)
+    go sw.redial(name, l, p)
+    return nil
+}
+
+// redial waits for the port to go down and dials again, backing off
+// while the VM is away
+func (sw *Switch)redial(name string, l *link, p *Port) {
+    for {
+	select {
+	case <-p.done:
+	case <-l.stop:
+	    return
+	}
+	backoff := minBackoff
+	for {
+	    sw.Logf("port %s reconnect to %s in %v", name, l.addr, backoff)
+	    select {
+	    case <-time.After(backoff):
+	    case <-l.stop:
+		return
+	    }
+	    conn, err := net.DialTimeout("tcp", l.addr, dialTimeout)
+	    if err == nil {
+		var stopped bool
+		if p, stopped, err = sw.relink(name, l, conn); stopped {
+		    conn.Close()
+		    return
+		}
+		if err == nil {
+		    break
+		}
+		conn.Close()
+	    }
+	    sw.Logf("port %s: %v", name, err)
+	    if backoff *= 2; backoff > maxBackoff {
+		backoff = maxBackoff
+	    }
+	}
+    }
+}
+
+// relink plugs the redialed conn unless the link was removed or
+// replaced, the check and the plug are under the same lock so that
+// RemovePort can't slip in between
+func (sw *Switch)relink(name string, l *link, conn net.Conn) (*Port, bool, error) {
+    sw.mu.Lock()
+    if sw.links[name] != l {
+	sw.mu.Unlock()
+	return nil, true, nil
+    }
+    p, err := sw.plug(name, conn)
+    sw.mu.Unlock()
+    if err != nil {
+	return nil, false, err
+    }
+    sw.start(p)
+    return p, false, nil
+}
+
+// Listen accepts ports on tcp:host:port or unix:path, for qemu
+// -netdev socket,connect= and -netdev stream
+func (sw *Switch)Listen(spec string) (net.Listener, error) {
+    a := strings.SplitN(spec, ":", 2)
+    if len(a) != 2 || (a[0] != "tcp" && a[0] != "unix") {
+	return nil, fmt.Errorf("bad listen %q", spec)
+    }
+    l, err := net.Listen(a[0], a[1])
+    if err != nil {
+	return nil, err
+    }
+    sw.Logf("listen on %s", spec)
+    go sw.accept(a[0], l)
+    return l, nil
+}
+
+func (sw *Switch)accept(network string, l net.Listener) {
+    for {
+	conn, err := l.Accept()
+	if err != nil {
+	    sw.Logf("accept: %v", err)
+	    return
+	}
+	// unix peers have no address to name them by
+	name := network + ":" + remote(conn)
+	if network == "unix" {
+	    name = fmt.Sprintf("unix:%d", atomic.AddUint64(&sw.accepted, 1))
+	}
+	if err := sw.AddPort(name, conn); err != nil {
+	    sw.Logf("accept: %v", err)
+	    conn.Close()
+	}
+    }
+}
@@ -0,0 +1,205 @@
+// tools/sw / link_test.go
+//
+// MIT License Copyright(c) 2021 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+//
+package main
+
+import (
+    "io/ioutil"
+    "net"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+)
+
+func quiet(sw *Switch, t *testing.T) *Switch {
+    sw.Logf = t.Logf
+    return sw
+}
+
+func waitState(t *testing.T, sw *Switch, name, state string) {
+    deadline := time.Now().Add(2 * time.Second)
+    for time.Now().Before(deadline) {
+	for _, p := range sw.PortInfos() {
+	    if p.Name == name && p.State == state {
+		return
+	    }
+	}
+	time.Sleep(time.Millisecond)
+    }
+    t.Fatalf("%s is not %s: %v", name, state, sw.PortInfos())
+}
+
+func TestReconnect(t *testing.T) {
+    minBackoff = 10 * time.Millisecond
+    sw := quiet(NewSwitch(), t)
+    l, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+	t.Fatal(err)
+    }
+    defer l.Close()
+    conns := make(chan net.Conn, 4)
+    go func() {
+	for {
+	    conn, err := l.Accept()
+	    if err != nil {
+		return
+	    }
+	    conns <- conn
+	}
+    }()
+    if err := sw.Dial("vm", l.Addr().String()); err != nil {
+	t.Fatal(err)
+    }
+    first := <-conns
+    waitState(t, sw, "vm", "up")
+    // the VM restarts
+    first.Close()
+    select {
+    case second := <-conns:
+	defer second.Close()
+    case <-time.After(2 * time.Second):
+	t.Fatal("no reconnect")
+    }
+    waitState(t, sw, "vm", "up")
+    // removing it stops the redial
+    if err := sw.RemovePort("vm"); err != nil {
+	t.Fatal(err)
+    }
+    select {
+    case conn := <-conns:
+	t.Errorf("redialed after remove %v", conn.LocalAddr())
+    case <-time.After(100 * time.Millisecond):
+    }
+    if len(sw.PortInfos()) != 0 {
+	t.Errorf("ports %v", sw.PortInfos())
+    }
+}
+
+func TestDialTwice(t *testing.T) {
+    // the redial waits, the VM is powered off
+    minBackoff = time.Hour
+    defer func() { minBackoff = time.Second }()
+    sw := quiet(NewSwitch(), t)
+    l, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+	t.Fatal(err)
+    }
+    defer l.Close()
+    conns := make(chan net.Conn, 4)
+    go func() {
+	for {
+	    conn, err := l.Accept()
+	    if err != nil {
+		return
+	    }
+	    conns <- conn
+	}
+    }()
+    addr := l.Addr().String()
+    if err := sw.Dial("vm", addr); err != nil {
+	t.Fatal(err)
+    }
+    first := <-conns
+    waitState(t, sw, "vm", "up")
+    // plugged again while up, the port stays
+    if err := sw.Dial("vm", addr); err != nil {
+	t.Errorf("dial twice: %v", err)
+    }
+    dup := <-conns
+    dup.SetDeadline(time.Now().Add(time.Second))
+    if _, err := dup.Read(make([]byte, 1)); err == nil {
+	t.Errorf("second conn is kept")
+    }
+    dup.Close()
+    if infos := sw.PortInfos(); len(infos) != 1 || infos[0].State != "up" {
+	t.Errorf("ports %v", infos)
+    }
+    // powered off and launched again
+    first.Close()
+    waitState(t, sw, "vm", "reconnecting")
+    if err := sw.Dial("vm", addr); err != nil {
+	t.Fatalf("dial after power off: %v", err)
+    }
+    second := <-conns
+    defer second.Close()
+    waitState(t, sw, "vm", "up")
+    f := frame(bcast, macA, "again")
+    sw.forward(&Port{ name: "other" }, f)
+    second.SetDeadline(time.Now().Add(time.Second))
+    if got, err := readFrame(second); err != nil || string(got) != string(f) {
+	t.Errorf("got %x %v", got, err)
+    }
+    if err := sw.RemovePort("vm"); err != nil {
+	t.Fatal(err)
+    }
+    if len(sw.PortInfos()) != 0 {
+	t.Errorf("ports %v", sw.PortInfos())
+    }
+}
+
+func TestRemoveWhileReconnecting(t *testing.T) {
+    minBackoff = 10 * time.Millisecond
+    sw := quiet(NewSwitch(), t)
+    l, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+	t.Fatal(err)
+    }
+    addr := l.Addr().String()
+    go func() {
+	if conn, err := l.Accept(); err == nil {
+	    conn.Close()
+	}
+	l.Close()
+    }()
+    if err := sw.Dial("vm", addr); err != nil {
+	t.Fatal(err)
+    }
+    waitState(t, sw, "vm", "reconnecting")
+    if err := sw.RemovePort("vm"); err != nil {
+	t.Fatal(err)
+    }
+    if len(sw.PortInfos()) != 0 {
+	t.Errorf("ports %v", sw.PortInfos())
+    }
+}
+
+func TestListen(t *testing.T) {
+    dir, err := ioutil.TempDir("", "sw")
+    if err != nil {
+	t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+    sw := quiet(NewSwitch(), t)
+    path := filepath.Join(dir, "sw.sock")
+    l, err := sw.Listen("unix:" + path)
+    if err != nil {
+	t.Fatal(err)
+    }
+    defer l.Close()
+    if _, err := sw.Listen("udp:127.0.0.1:1111"); err == nil {
+	t.Errorf("listen on udp")
+    }
+    a, err := net.Dial("unix", path)
+    if err != nil {
+	t.Fatal(err)
+    }
+    defer a.Close()
+    b, err := net.Dial("unix", path)
+    if err != nil {
+	t.Fatal(err)
+    }
+    defer b.Close()
+    waitState(t, sw, "unix:2", "up")
+    f := frame(bcast, macA, "stream")
+    if err := writeFrame(a, f); err != nil {
+	t.Fatal(err)
+    }
+    b.SetDeadline(time.Now().Add(time.Second))
+    got, err := readFrame(b)
+    if err != nil || string(got) != string(f) {
+	t.Errorf("got %x %v", got, err)
+    }
+}
@@ -6,110 +6,103 @@
 package main
 
 import (
-    "encoding/binary"
+    "encoding/json"
     "fmt"
     "net"
     "os"
+    "strings"
+    "time"
+
+    ctl "vm/sw"
 )
 
-type Plug struct {
-    target string
-    conn net.Conn
-    state int
-    learn map[string]int
-}
+var sw *Switch
 
-var plugs map[string]*Plug
+func connect(port, addr string) error {
+    if addr == "" {
+	return fmt.Errorf("connect: no addr")
+    }
+    if port == "" {
+	port = addr
+    }
+    if err := sw.Dial(port, addr); err != nil {
+	return fmt.Errorf("connect: %v", err)
+    }
+    return nil
+}
 
-func (plug *Plug)miss(dst string) bool {
-    v, ok := plug.learn[dst]
-    if ok && v == 1 {
-	return false
+func disconnect(port string) error {
+    if err := sw.RemovePort(port); err != nil {
+	return fmt.Errorf("disconnect: %v", err)
     }
-    return true
+    return nil
 }
 
-func (plug *Plug)communication() {
-    defer func() { plug.state = -1 }()
-    conn := plug.conn
-    var r int
-    for {
-	szbuf := make([]byte, 4)
-	r, _ = conn.Read(szbuf)
-	if r <= 0 {
-	    return
+// handle runs one control request
+func handle(req *ctl.Request) *ctl.Response {
+    resp := &ctl.Response{}
+    var err error
+    switch req.Command {
+    case ctl.Connect:
+	err = connect(req.Port, req.Addr)
+    case ctl.Disconnect:
+	err = disconnect(req.Port)
+    case ctl.ListPorts:
+	resp.Ports = sw.PortInfos()
+    case ctl.ShowMACTable:
+	resp.Table = sw.Table()
+    case ctl.Stats:
+	resp.Stats = sw.Stats()
+    case ctl.Capture:
+	if req.Port == "" || req.File == "" {
+	    err = fmt.Errorf("capture: needs port and file")
+	    break
+	}
+	if err = sw.StartCapture(req.Port, req.File, req.Filter); err != nil {
+	    err = fmt.Errorf("capture: %v", err)
+	}
+    case ctl.CaptureStop:
+	if resp.Frames, err = sw.StopCapture(req.File); err != nil {
+	    err = fmt.Errorf("capture-stop: %v", err)
 	}
-	sz := binary.BigEndian.Uint32(szbuf)
-	//fmt.Printf("packet: %d\n", sz)
-	msgbuf := make([]byte, sz)
-	r, _ = conn.Read(msgbuf)
-	if r <= 0 {
-	    return
+    case ctl.SetPort:
+	if req.Port == "" || len(req.Settings) == 0 {
+	    err = fmt.Errorf("set-port: needs port and settings")
+	    break
 	}
-	// show 1st 12 bytes + 4
-	//fmt.Println(msgbuf[:16])
-	dst := msgbuf[:6]
-	src := msgbuf[6:12]
-	// learn src
-	plug.learn[string(src)] = 1
-	for k, v := range plugs {
-	    if k == plug.target {
-		continue
-	    }
-	    if (src[0] & 0x01) == 0 {
-		v.learn[string(src)] = 0
-	    }
-	    if (dst[0] & 0x01) == 0 {
-		if v.miss(string(dst)) {
-		    continue
-		}
-	    }
-	    //fmt.Printf("sent to %s\n", k)
-	    v.conn.Write(szbuf)
-	    v.conn.Write(msgbuf)
+	c, e := sw.SetPort(req.Port, req.Settings)
+	if e != nil {
+	    err = fmt.Errorf("set-port: %v", e)
+	    break
 	}
+	resp.Configs = map[string]ctl.PortConfig{ req.Port: c }
+    case ctl.ShowConfig:
+	resp.Configs = sw.Configs()
+    default:
+	err = fmt.Errorf("unknown command %q", req.Command)
     }
-}
-
-func connect(target string) {
-    plug := &Plug{ target: target }
-    plugs[target] = plug
-    //
-    conn, err := net.Dial("tcp", target)
     if err != nil {
-	fmt.Printf("connect error: %s\n", err)
-	return
+	resp.Error = err.Error()
     }
-    plug.conn = conn
-    plug.learn = map[string]int{}
-    go plug.communication()
-}
-
-func disconnect(target string) {
+    return resp
 }
 
 func control(conn net.Conn) {
     defer conn.Close()
+    conn.SetDeadline(time.Now().Add(10 * time.Second))
 
-    buf := make([]byte, 256)
-    r, _ := conn.Read(buf)
-    if r <= 0 {
+    req := &ctl.Request{}
+    if err := json.NewDecoder(conn).Decode(req); err != nil {
+	json.NewEncoder(conn).Encode(&ctl.Response{ Error: fmt.Sprintf("bad request: %v", err) })
 	return
     }
-
-    msg := string(buf[:r])
-    op := msg[0]
-    target := msg[1:]
-    fmt.Printf("op: %c target: %s\n", op, target)
-    switch op {
-    case '+': connect(target)
-    case '-': disconnect(target)
-    }
+    fmt.Printf("command: %s port: %s addr: %s\n", req.Command, req.Port, req.Addr)
+    json.NewEncoder(conn).Encode(handle(req))
 }
 
 func instance(name string) {
     fmt.Println(name)
-    sockpath := fmt.Sprintf("/tmp/vm-sw-%s.sock", name)
+    sockpath := ctl.SockPath(name)
     fmt.Println(sockpath)
 
     // remove
@@ -126,15 +119,47 @@ func instance(name string) {
 	if err != nil {
 	    continue
 	}
-	control(conn)
+	go control(conn)
     }
 }
 
+// sw [name] [--listen tcp:host:port|unix:path]... [--config file]
 func main() {
     name := fmt.Sprintf("%d", os.Getpid())
-    if len(os.Args) > 1 {
-	name = os.Args[1]
+    listens := []string{}
+    config := ""
+    args := os.Args[1:]
+    for i := 0; i < len(args); i++ {
+	switch {
+	case args[i] == "--listen" && i + 1 < len(args):
+	    i++
+	    listens = append(listens, args[i])
+	case strings.HasPrefix(args[i], "--listen="):
+	    listens = append(listens, strings.TrimPrefix(args[i], "--listen="))
+	case args[i] == "--config" && i + 1 < len(args):
+	    i++
+	    config = args[i]
+	case strings.HasPrefix(args[i], "--config="):
+	    config = strings.TrimPrefix(args[i], "--config=")
+	default:
+	    name = args[i]
+	}
+    }
+    if config == "" {
+	config = DefaultConfigFile(name)
+    }
+    sw = NewSwitch()
+    sw.ConfigFile = config
+    if err := sw.LoadConfig(); err != nil {
+	fmt.Printf("error: %s\n", err)
+	os.Exit(1)
+    }
+    go sw.Ager(make(chan struct{}))
+    for _, spec := range listens {
+	if _, err := sw.Listen(spec); err != nil {
+	    fmt.Printf("error: %s\n", err)
+	    os.Exit(1)
+	}
     }
-    plugs = map[string]*Plug{}
     instance(name)
 }
@@ -0,0 +1,67 @@
+// tools/sw / main_test.go
+//
+// MIT License Copyright(c) 2021 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+//
+package main
+
+import (
+    "net"
+    "testing"
+
+    ctl "vm/sw"
+)
+
+func TestHandle(t *testing.T) {
+    sw = NewSwitch()
+    l, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+	t.Fatal(err)
+    }
+    defer l.Close()
+    accepted := make(chan net.Conn, 1)
+    go func() {
+	conn, err := l.Accept()
+	if err == nil {
+	    accepted <- conn
+	}
+    }()
+    addr := l.Addr().String()
+    if resp := handle(&ctl.Request{ Command: ctl.Connect, Port: "vm1", Addr: addr }); resp.Error != "" {
+	t.Fatal(resp.Error)
+    }
+    vm1 := <-accepted
+    defer vm1.Close()
+    resp := handle(&ctl.Request{ Command: ctl.ListPorts })
+    if len(resp.Ports) != 1 || resp.Ports[0].Name != "vm1" || resp.Ports[0].Remote != addr {
+	t.Errorf("ports %v", resp.Ports)
+    }
+    // a relaunch plugs again
+    if resp := handle(&ctl.Request{ Command: ctl.Connect, Port: "vm1", Addr: addr }); resp.Error != "" {
+	t.Errorf("connect twice: %s", resp.Error)
+    }
+    resp = handle(&ctl.Request{ Command: ctl.Stats })
+    if resp.Stats == nil || len(resp.Stats.Ports) != 1 {
+	t.Errorf("stats %v", resp.Stats)
+    }
+    if resp := handle(&ctl.Request{ Command: ctl.Disconnect, Port: "vm1" }); resp.Error != "" {
+	t.Error(resp.Error)
+    }
+    if resp := handle(&ctl.Request{ Command: ctl.Disconnect, Port: "vm1" }); resp.Error != "disconnect: no port vm1" {
+	t.Errorf("disconnect twice: %q", resp.Error)
+    }
+    resp = handle(&ctl.Request{ Command: ctl.SetPort, Port: "vm1", Settings: []string{ "mode=access", "vlan=10" } })
+    if resp.Error != "" || resp.Configs["vm1"].VLAN != 10 {
+	t.Errorf("set-port: %q %v", resp.Error, resp.Configs)
+    }
+    if resp := handle(&ctl.Request{ Command: ctl.SetPort, Port: "vm1", Settings: []string{ "mode=hybrid" } }); resp.Error != `set-port: bad mode "hybrid"` {
+	t.Errorf("set-port hybrid: %q", resp.Error)
+    }
+    resp = handle(&ctl.Request{ Command: ctl.ShowConfig })
+    if len(resp.Configs) != 1 || resp.Configs["vm1"].Mode != "access" {
+	t.Errorf("show-config %v", resp.Configs)
+    }
+    if resp := handle(&ctl.Request{ Command: "reboot" }); resp.Error != `unknown command "reboot"` {
+	t.Errorf("unknown: %q", resp.Error)
+    }
+}
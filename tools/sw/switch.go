@@ -0,0 +1,441 @@
+// tools/sw / switch.go
+//
+// MIT License Copyright(c) 2021 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+//
+package main
+
+import (
+    "encoding/binary"
+    "fmt"
+    "io"
+    "log"
+    "net"
+    "sort"
+    "sync"
+    "sync/atomic"
+    "time"
+
+    ctl "vm/sw"
+)
+
+// frames on a qemu socket netdev are a 4 bytes big endian length and the frame
+const maxFrame = 65536 + 14
+
+// DefaultAging is how long a learned MAC stays without traffic from it
+const DefaultAging = 300 * time.Second
+
+// queue depth of a port, frames are dropped when the peer is too slow
+const portQueue = 256
+
+func readFrame(r io.Reader) ([]byte, error) {
+    szbuf := make([]byte, 4)
+    if _, err := io.ReadFull(r, szbuf); err != nil {
+	return nil, err
+    }
+    sz := binary.BigEndian.Uint32(szbuf)
+    if sz < 14 || sz > maxFrame {
+	return nil, fmt.Errorf("bad frame size %d", sz)
+    }
+    frame := make([]byte, sz)
+    if _, err := io.ReadFull(r, frame); err != nil {
+	return nil, err
+    }
+    return frame, nil
+}
+
+func writeFrame(w io.Writer, frame []byte) error {
+    buf := make([]byte, 4 + len(frame))
+    binary.BigEndian.PutUint32(buf, uint32(len(frame)))
+    copy(buf[4:], frame)
+    _, err := w.Write(buf)
+    return err
+}
+
+type MAC [6]byte
+
+func (m MAC)String() string {
+    return net.HardwareAddr(m[:]).String()
+}
+
+// group is set for broadcast and multicast
+func (m MAC)group() bool {
+    return m[0] & 0x01 != 0
+}
+
+// Port is a connection to a VM, frames to it go through its queue
+type Port struct {
+    // counters first for the 64bit atomics
+    rxFrames, rxBytes, txFrames, txBytes, drops uint64
+    sw *Switch
+    name string
+    conn net.Conn
+    queue chan []byte
+    done chan struct{}
+    once sync.Once
+}
+
+func (p *Port)writer() {
+    for {
+	select {
+	case frame := <-p.queue:
+	    p.sw.capture(p.name, false, frame)
+	    if err := writeFrame(p.conn, frame); err != nil {
+		p.close()
+		return
+	    }
+	    atomic.AddUint64(&p.txFrames, 1)
+	    atomic.AddUint64(&p.txBytes, uint64(len(frame)))
+	case <-p.done:
+	    return
+	}
+    }
+}
+
+// send queues the frame and never blocks the sender
+func (p *Port)send(frame []byte) bool {
+    select {
+    case p.queue <- frame:
+	return true
+    case <-p.done:
+    default:
+	atomic.AddUint64(&p.drops, 1)
+    }
+    return false
+}
+
+func (p *Port)close() {
+    p.once.Do(func() {
+	close(p.done)
+	p.conn.Close()
+    })
+}
+
+func remote(conn net.Conn) string {
+    if addr := conn.RemoteAddr(); addr != nil {
+	return addr.String()
+    }
+    return ""
+}
+
+type entry struct {
+    port *Port
+    seen time.Time
+}
+
+// Switch is a learning switch, the MAC table and the ports are under mu
+type Switch struct {
+    forwarded, flooded, filtered uint64
+    // accepted numbers the unix ports
+    accepted uint64
+    Aging time.Duration
+    // Logf reports the port events
+    Logf func(format string, args ...interface{})
+    mu sync.Mutex
+    ports map[string]*Port
+    // links are the dialed ports, they are redialed when lost
+    links map[string]*link
+    capMu sync.Mutex
+    captures []*Capture
+    table map[vlanKey]entry
+    // configs are the VLAN settings by port name, saved in ConfigFile
+    configs map[string]ctl.PortConfig
+    ConfigFile string
+    // saveMu serializes the changes and the writes of ConfigFile
+    saveMu sync.Mutex
+    now func() time.Time
+}
+
+func NewSwitch() *Switch {
+    return &Switch{
+	Aging: DefaultAging,
+	Logf: log.Printf,
+	ports: map[string]*Port{},
+	links: map[string]*link{},
+	table: map[vlanKey]entry{},
+	configs: map[string]ctl.PortConfig{},
+	now: time.Now,
+    }
+}
+
+// AddPort plugs conn in as name and starts switching its frames
+func (sw *Switch)AddPort(name string, conn net.Conn) error {
+    _, err := sw.addPort(name, conn)
+    return err
+}
+
+func (sw *Switch)addPort(name string, conn net.Conn) (*Port, error) {
+    sw.mu.Lock()
+    p, err := sw.plug(name, conn)
+    sw.mu.Unlock()
+    if err != nil {
+	return nil, err
+    }
+    sw.start(p)
+    return p, nil
+}
+
+// plug needs mu, the port does nothing until start
+func (sw *Switch)plug(name string, conn net.Conn) (*Port, error) {
+    if _, ok := sw.ports[name]; ok {
+	return nil, fmt.Errorf("port %s exists", name)
+    }
+    p := &Port{
+	sw: sw,
+	name: name,
+	conn: conn,
+	queue: make(chan []byte, portQueue),
+	done: make(chan struct{}),
+    }
+    sw.ports[name] = p
+    return p, nil
+}
+
+func (sw *Switch)start(p *Port) {
+    sw.Logf("port %s up %s", p.name, remote(p.conn))
+    go p.writer()
+    go sw.reader(p)
+}
+
+// RemovePort unplugs the port and forgets the MACs behind it,
+// a dialed port stops reconnecting
+func (sw *Switch)RemovePort(name string) error {
+    sw.mu.Lock()
+    p, ok := sw.ports[name]
+    if ok {
+	sw.unplug(p)
+    }
+    l, linked := sw.links[name]
+    if linked {
+	delete(sw.links, name)
+	close(l.stop)
+    }
+    sw.mu.Unlock()
+    if !ok && !linked {
+	return fmt.Errorf("no port %s", name)
+    }
+    if ok {
+	p.close()
+    }
+    sw.Logf("port %s removed", name)
+    return nil
+}
+
+// unplug needs mu
+func (sw *Switch)unplug(p *Port) {
+    if sw.ports[p.name] == p {
+	delete(sw.ports, p.name)
+    }
+    for key, e := range sw.table {
+	if e.port == p {
+	    delete(sw.table, key)
+	}
+    }
+}
+
+func (sw *Switch)reader(p *Port) {
+    for {
+	frame, err := readFrame(p.conn)
+	if err != nil {
+	    sw.mu.Lock()
+	    up := sw.ports[p.name] == p
+	    sw.unplug(p)
+	    sw.mu.Unlock()
+	    p.close()
+	    if up {
+		sw.Logf("port %s down: %v", p.name, err)
+	    }
+	    return
+	}
+	atomic.AddUint64(&p.rxFrames, 1)
+	atomic.AddUint64(&p.rxBytes, uint64(len(frame)))
+	sw.capture(p.name, true, frame)
+	sw.forward(p, frame)
+    }
+}
+
+type output struct {
+    port *Port
+    frame []byte
+}
+
+// forward learns the source and sends the frame to where the destination is,
+// everywhere but the ingress when it is unknown, broadcast or multicast.
+// Frames stay in their VLAN and isolated ports reach the uplinks only.
+func (sw *Switch)forward(in *Port, frame []byte) {
+    var dst, src MAC
+    copy(dst[:], frame[0:6])
+    copy(src[:], frame[6:12])
+    now := sw.now()
+    sw.mu.Lock()
+    conf := sw.config(in.name)
+    vid, frame, ok := ingress(conf, frame)
+    if !ok {
+	sw.mu.Unlock()
+	atomic.AddUint64(&in.drops, 1)
+	return
+    }
+    if !src.group() {
+	// the latest port owns the MAC, it may have moved
+	sw.table[vlanKey{ vid, src }] = entry{ port: in, seen: now }
+    }
+    dkey := vlanKey{ vid, dst }
+    e, ok := sw.table[dkey]
+    if ok && now.Sub(e.seen) > sw.Aging {
+	delete(sw.table, dkey)
+	ok = false
+    }
+    cands := []*Port{}
+    if !dst.group() && ok {
+	if e.port == in {
+	    sw.mu.Unlock()
+	    atomic.AddUint64(&sw.filtered, 1)
+	    return
+	}
+	cands = append(cands, e.port)
+	atomic.AddUint64(&sw.forwarded, 1)
+    } else {
+	for _, p := range sw.ports {
+	    if p != in {
+		cands = append(cands, p)
+	    }
+	}
+	atomic.AddUint64(&sw.flooded, 1)
+    }
+    outs := []output{}
+    for _, p := range cands {
+	pconf := sw.config(p.name)
+	if !conf.Reaches(pconf) {
+	    continue
+	}
+	if f := egress(pconf, vid, frame); f != nil {
+	    outs = append(outs, output{ p, f })
+	}
+    }
+    sw.mu.Unlock()
+    for _, o := range outs {
+	o.port.send(o.frame)
+    }
+}
+
+// Age drops the entries not seen within Aging
+func (sw *Switch)Age() {
+    now := sw.now()
+    sw.mu.Lock()
+    defer sw.mu.Unlock()
+    for key, e := range sw.table {
+	if now.Sub(e.seen) > sw.Aging {
+	    delete(sw.table, key)
+	}
+    }
+}
+
+// Ager runs Age periodically until stop is closed
+func (sw *Switch)Ager(stop chan struct{}) {
+    interval := sw.Aging / 2
+    if interval <= 0 {
+	interval = time.Second
+    }
+    t := time.NewTicker(interval)
+    defer t.Stop()
+    for {
+	select {
+	case <-t.C:
+	    sw.Age()
+	case <-stop:
+	    return
+	}
+    }
+}
+
+// Lookup returns the port name a MAC was learned on in any VLAN
+func (sw *Switch)Lookup(mac MAC) (string, bool) {
+    sw.mu.Lock()
+    defer sw.mu.Unlock()
+    for key, e := range sw.table {
+	if key.mac == mac && sw.now().Sub(e.seen) <= sw.Aging {
+	    return e.port.name, true
+	}
+    }
+    return "", false
+}
+
+// Ports returns the port names
+func (sw *Switch)Ports() []string {
+    sw.mu.Lock()
+    defer sw.mu.Unlock()
+    names := []string{}
+    for name := range sw.ports {
+	names = append(names, name)
+    }
+    sort.Strings(names)
+    return names
+}
+
+// PortInfos lists the ports for list-ports
+func (sw *Switch)PortInfos() []ctl.PortInfo {
+    sw.mu.Lock()
+    defer sw.mu.Unlock()
+    infos := []ctl.PortInfo{}
+    for _, p := range sw.ports {
+	infos = append(infos, ctl.PortInfo{ Name: p.name, Remote: remote(p.conn), State: "up" })
+    }
+    for name, l := range sw.links {
+	if _, ok := sw.ports[name]; !ok {
+	    infos = append(infos, ctl.PortInfo{ Name: name, Remote: l.addr, State: "reconnecting" })
+	}
+    }
+    sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+    return infos
+}
+
+// Table returns the live MAC table for show-mac-table
+func (sw *Switch)Table() []ctl.MACEntry {
+    now := sw.now()
+    sw.mu.Lock()
+    defer sw.mu.Unlock()
+    table := []ctl.MACEntry{}
+    for key, e := range sw.table {
+	age := now.Sub(e.seen)
+	if age > sw.Aging {
+	    continue
+	}
+	table = append(table, ctl.MACEntry{
+	    VLAN: key.vlan,
+	    MAC: key.mac.String(),
+	    Port: e.port.name,
+	    Age: int(age.Seconds()),
+	})
+    }
+    sort.Slice(table, func(i, j int) bool {
+	if table[i].VLAN != table[j].VLAN {
+	    return table[i].VLAN < table[j].VLAN
+	}
+	return table[i].MAC < table[j].MAC
+    })
+    return table
+}
+
+// Stats returns the counters of the switch and its ports
+func (sw *Switch)Stats() *ctl.SwitchStats {
+    stats := &ctl.SwitchStats{
+	Forwarded: atomic.LoadUint64(&sw.forwarded),
+	Flooded: atomic.LoadUint64(&sw.flooded),
+	Filtered: atomic.LoadUint64(&sw.filtered),
+	Ports: []ctl.PortStats{},
+    }
+    sw.mu.Lock()
+    defer sw.mu.Unlock()
+    for _, p := range sw.ports {
+	stats.Ports = append(stats.Ports, ctl.PortStats{
+	    Name: p.name,
+	    RxFrames: atomic.LoadUint64(&p.rxFrames),
+	    RxBytes: atomic.LoadUint64(&p.rxBytes),
+	    TxFrames: atomic.LoadUint64(&p.txFrames),
+	    TxBytes: atomic.LoadUint64(&p.txBytes),
+	    Drops: atomic.LoadUint64(&p.drops),
+	})
+    }
+    sort.Slice(stats.Ports, func(i, j int) bool { return stats.Ports[i].Name < stats.Ports[j].Name })
+    return stats
+}
@@ -0,0 +1,235 @@
+// tools/sw / switch_test.go
+//
+// MIT License Copyright(c) 2021 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+//
+package main
+
+import (
+    "bytes"
+    "encoding/binary"
+    "net"
+    "testing"
+    "time"
+)
+
+var (
+    macA = MAC{ 0x52, 0x54, 0x00, 0x00, 0x00, 0x0a }
+    macB = MAC{ 0x52, 0x54, 0x00, 0x00, 0x00, 0x0b }
+    macC = MAC{ 0x52, 0x54, 0x00, 0x00, 0x00, 0x0c }
+    bcast = MAC{ 0xff, 0xff, 0xff, 0xff, 0xff, 0xff }
+    mcast = MAC{ 0x01, 0x00, 0x5e, 0x00, 0x00, 0x01 }
+)
+
+func frame(dst, src MAC, payload string) []byte {
+    f := append(append(append([]byte{}, dst[:]...), src[:]...), 0x08, 0x00)
+    return append(f, payload...)
+}
+
+// vm is the far end of a port
+type vm struct {
+    conn net.Conn
+    frames chan []byte
+}
+
+func plug(t *testing.T, sw *Switch, name string) *vm {
+    near, far := net.Pipe()
+    if err := sw.AddPort(name, near); err != nil {
+	t.Fatal(err)
+    }
+    v := &vm{ conn: far, frames: make(chan []byte, 16) }
+    go func() {
+	for {
+	    f, err := readFrame(far)
+	    if err != nil {
+		close(v.frames)
+		return
+	    }
+	    v.frames <- f
+	}
+    }()
+    return v
+}
+
+func (v *vm)send(t *testing.T, f []byte) {
+    if err := writeFrame(v.conn, f); err != nil {
+	t.Fatal(err)
+    }
+}
+
+func (v *vm)expect(t *testing.T, name string, f []byte) {
+    select {
+    case got, ok := <-v.frames:
+	if !ok {
+	    t.Fatalf("%s: closed", name)
+	}
+	if !bytes.Equal(got, f) {
+	    t.Fatalf("%s: got %x, want %x", name, got, f)
+	}
+    case <-time.After(time.Second):
+	t.Fatalf("%s: no frame", name)
+    }
+}
+
+func (v *vm)nothing(t *testing.T, name string) {
+    select {
+    case got := <-v.frames:
+	t.Fatalf("%s: unexpected %x", name, got)
+    case <-time.After(50 * time.Millisecond):
+    }
+}
+
+// learned waits for the reader goroutine to record mac on port
+func learned(t *testing.T, sw *Switch, mac MAC, port string) {
+    deadline := time.Now().Add(time.Second)
+    for time.Now().Before(deadline) {
+	if p, ok := sw.Lookup(mac); ok && p == port {
+	    return
+	}
+	time.Sleep(time.Millisecond)
+    }
+    t.Fatalf("%s is not on %s", mac, port)
+}
+
+func TestLearning(t *testing.T) {
+    sw := NewSwitch()
+    a, b, c := plug(t, sw, "a"), plug(t, sw, "b"), plug(t, sw, "c")
+    // unknown destination floods
+    f := frame(macB, macA, "hello")
+    a.send(t, f)
+    b.expect(t, "b", f)
+    c.expect(t, "c", f)
+    learned(t, sw, macA, "a")
+    // the reply goes to a only and teaches b
+    f = frame(macA, macB, "reply")
+    b.send(t, f)
+    a.expect(t, "a", f)
+    c.nothing(t, "c")
+    learned(t, sw, macB, "b")
+    f = frame(macB, macA, "again")
+    a.send(t, f)
+    b.expect(t, "b", f)
+    c.nothing(t, "c")
+    // a frame to a MAC behind its own ingress port is dropped
+    sw.mu.Lock()
+    sw.table[vlanKey{ 1, macC }] = entry{ port: sw.ports["b"], seen: sw.now() }
+    sw.mu.Unlock()
+    b.send(t, frame(macC, macB, "local"))
+    a.nothing(t, "a")
+    c.nothing(t, "c")
+}
+
+func TestFlood(t *testing.T) {
+    sw := NewSwitch()
+    a, b, c := plug(t, sw, "a"), plug(t, sw, "b"), plug(t, sw, "c")
+    for _, dst := range []MAC{ bcast, mcast } {
+	f := frame(dst, macA, "group")
+	a.send(t, f)
+	b.expect(t, "b", f)
+	c.expect(t, "c", f)
+	a.nothing(t, "a")
+    }
+    // a group source is never learned
+    b.send(t, frame(macA, mcast, "bogus"))
+    a.expect(t, "a", frame(macA, mcast, "bogus"))
+    if _, ok := sw.Lookup(mcast); ok {
+	t.Errorf("multicast source learned")
+    }
+}
+
+func TestAging(t *testing.T) {
+    sw := NewSwitch()
+    now := time.Unix(1000, 0)
+    sw.now = func() time.Time { return now }
+    a, b, c := plug(t, sw, "a"), plug(t, sw, "b"), plug(t, sw, "c")
+    a.send(t, frame(bcast, macA, "hi"))
+    b.expect(t, "b", frame(bcast, macA, "hi"))
+    c.expect(t, "c", frame(bcast, macA, "hi"))
+    learned(t, sw, macA, "a")
+    now = now.Add(sw.Aging + time.Second)
+    if _, ok := sw.Lookup(macA); ok {
+	t.Errorf("aged entry found")
+    }
+    // an aged destination floods again
+    f := frame(macA, macB, "who")
+    b.send(t, f)
+    a.expect(t, "a", f)
+    c.expect(t, "c", f)
+    now = now.Add(sw.Aging + time.Second)
+    sw.Age()
+    sw.mu.Lock()
+    n := len(sw.table)
+    sw.mu.Unlock()
+    if n != 0 {
+	t.Errorf("%d entries after Age", n)
+    }
+}
+
+func TestMove(t *testing.T) {
+    sw := NewSwitch()
+    a, b, c := plug(t, sw, "a"), plug(t, sw, "b"), plug(t, sw, "c")
+    a.send(t, frame(bcast, macA, "1"))
+    b.expect(t, "b", frame(bcast, macA, "1"))
+    c.expect(t, "c", frame(bcast, macA, "1"))
+    learned(t, sw, macA, "a")
+    // macA moves behind c
+    c.send(t, frame(bcast, macA, "2"))
+    a.expect(t, "a", frame(bcast, macA, "2"))
+    b.expect(t, "b", frame(bcast, macA, "2"))
+    learned(t, sw, macA, "c")
+    f := frame(macA, macB, "3")
+    b.send(t, f)
+    c.expect(t, "c", f)
+    a.nothing(t, "a")
+}
+
+func TestRemovePort(t *testing.T) {
+    sw := NewSwitch()
+    a, b := plug(t, sw, "a"), plug(t, sw, "b")
+    a.send(t, frame(bcast, macA, "hi"))
+    b.expect(t, "b", frame(bcast, macA, "hi"))
+    learned(t, sw, macA, "a")
+    if err := sw.RemovePort("a"); err != nil {
+	t.Fatal(err)
+    }
+    if _, ok := sw.Lookup(macA); ok {
+	t.Errorf("entry of a removed port")
+    }
+    if _, ok := <-a.frames; ok {
+	t.Errorf("a is still open")
+    }
+    if err := sw.RemovePort("a"); err == nil {
+	t.Errorf("removed twice")
+    }
+    // the peer going away unplugs the port as well
+    b.conn.Close()
+    deadline := time.Now().Add(time.Second)
+    for len(sw.Ports()) != 0 {
+	if time.Now().After(deadline) {
+	    t.Fatalf("ports %v", sw.Ports())
+	}
+	time.Sleep(time.Millisecond)
+    }
+}
+
+func TestFraming(t *testing.T) {
+    sw := NewSwitch()
+    a, b := plug(t, sw, "a"), plug(t, sw, "b")
+    // the header and the frame in pieces
+    f := frame(bcast, macA, "split")
+    buf := make([]byte, 4 + len(f))
+    binary.BigEndian.PutUint32(buf, uint32(len(f)))
+    copy(buf[4:], f)
+    for _, piece := range [][]byte{ buf[:2], buf[2:7], buf[7:] } {
+	if _, err := a.conn.Write(piece); err != nil {
+	    t.Fatal(err)
+	}
+    }
+    b.expect(t, "b", f)
+    // a runt drops the port
+    binary.BigEndian.PutUint32(buf, 3)
+    a.conn.Write(buf[:7])
+    if _, ok := <-a.frames; ok {
+	t.Errorf("a survived a runt")
+    }
+}
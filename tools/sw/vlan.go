@@ -0,0 +1,192 @@
+// tools/sw / vlan.go
+//
+// MIT License Copyright(c) 2021 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+//
+package main
+
+import (
+    "encoding/binary"
+    "encoding/json"
+    "fmt"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+
+    ctl "vm/sw"
+)
+
+// 802.1Q tag protocol identifier
+const tpid = 0x8100
+
+// vlanKey is a MAC in a VLAN, each VLAN learns on its own
+type vlanKey struct {
+    vlan int
+    mac MAC
+}
+
+// untag returns the VID and the frame without its 802.1Q tag,
+// vid 0 means no tag or a priority tag only
+func untag(frame []byte) (int, []byte) {
+    if len(frame) < 18 || binary.BigEndian.Uint16(frame[12:14]) != tpid {
+	return 0, frame
+    }
+    vid := int(binary.BigEndian.Uint16(frame[14:16]) & 0x0fff)
+    f := make([]byte, 0, len(frame) - 4)
+    f = append(f, frame[:12]...)
+    return vid, append(f, frame[16:]...)
+}
+
+// tag inserts an 802.1Q tag with priority 0
+func tag(vid int, frame []byte) []byte {
+    f := make([]byte, 0, len(frame) + 4)
+    f = append(f, frame[:12]...)
+    f = append(f, byte(tpid >> 8), byte(tpid & 0xff), byte(vid >> 8), byte(vid))
+    return append(f, frame[12:]...)
+}
+
+// ingress classifies a frame from a port with c,
+// it returns the VLAN and the untagged frame, or false to drop it
+func ingress(c *ctl.PortConfig, frame []byte) (int, []byte, bool) {
+    vid, f := untag(frame)
+    if c.Mode == "access" {
+	// tagged frames have no place on an access port
+	if len(f) != len(frame) && vid != 0 {
+	    return 0, nil, false
+	}
+	return c.AccessVLAN(), f, true
+    }
+    if vid == 0 {
+	vid = c.Native
+    }
+    if vid == 0 || !c.Allows(vid) {
+	return 0, nil, false
+    }
+    return vid, f, true
+}
+
+// egress makes the frame to send to a port with c, nil if the port is not in vid
+func egress(c *ctl.PortConfig, vid int, frame []byte) []byte {
+    if c.Mode == "access" {
+	if vid != c.AccessVLAN() {
+	    return nil
+	}
+	return frame
+    }
+    if !c.Allows(vid) {
+	return nil
+    }
+    if vid == c.Native {
+	return frame
+    }
+    return tag(vid, frame)
+}
+
+// DefaultConfigFile is where the switch name keeps its port settings
+func DefaultConfigFile(name string) string {
+    dir, err := os.UserConfigDir()
+    if err != nil {
+	dir = os.TempDir()
+    }
+    return filepath.Join(dir, "vm", "sw", name + ".json")
+}
+
+// config needs mu
+func (sw *Switch)config(name string) *ctl.PortConfig {
+    if c, ok := sw.configs[name]; ok {
+	return &c
+    }
+    c := ctl.DefaultPortConfig()
+    return &c
+}
+
+// SetPort applies key=value settings to a port, it needs not be up yet.
+// The settings take effect once they are saved to ConfigFile.
+func (sw *Switch)SetPort(name string, settings []string) (ctl.PortConfig, error) {
+    // one change at a time from the control connections
+    sw.saveMu.Lock()
+    defer sw.saveMu.Unlock()
+    sw.mu.Lock()
+    c := *sw.config(name)
+    sw.mu.Unlock()
+    for _, s := range settings {
+	if err := c.Set(s); err != nil {
+	    return c, err
+	}
+    }
+    configs := sw.Configs()
+    configs[name] = c
+    if err := sw.save(configs); err != nil {
+	return c, err
+    }
+    sw.mu.Lock()
+    sw.configs[name] = c
+    // the learned MACs may be in the wrong VLAN now
+    for key, e := range sw.table {
+	if e.port.name == name {
+	    delete(sw.table, key)
+	}
+    }
+    sw.mu.Unlock()
+    sw.Logf("port %s config %s", name, c)
+    return c, nil
+}
+
+// Configs returns the port settings
+func (sw *Switch)Configs() map[string]ctl.PortConfig {
+    sw.mu.Lock()
+    defer sw.mu.Unlock()
+    configs := map[string]ctl.PortConfig{}
+    for name, c := range sw.configs {
+	configs[name] = c
+    }
+    return configs
+}
+
+// LoadConfig reads ConfigFile, no file is no settings
+func (sw *Switch)LoadConfig() error {
+    if sw.ConfigFile == "" {
+	return nil
+    }
+    data, err := ioutil.ReadFile(sw.ConfigFile)
+    if os.IsNotExist(err) {
+	return nil
+    }
+    if err != nil {
+	return err
+    }
+    configs := map[string]ctl.PortConfig{}
+    if err := json.Unmarshal(data, &configs); err != nil {
+	return fmt.Errorf("%s: %v", sw.ConfigFile, err)
+    }
+    sw.mu.Lock()
+    sw.configs = configs
+    sw.mu.Unlock()
+    return nil
+}
+
+// SaveConfig writes the settings to ConfigFile
+func (sw *Switch)SaveConfig() error {
+    sw.saveMu.Lock()
+    defer sw.saveMu.Unlock()
+    return sw.save(sw.Configs())
+}
+
+// save needs saveMu, the temporary file is ours then
+func (sw *Switch)save(configs map[string]ctl.PortConfig) error {
+    if sw.ConfigFile == "" {
+	return nil
+    }
+    data, err := json.MarshalIndent(configs, "", "  ")
+    if err != nil {
+	return err
+    }
+    if err := os.MkdirAll(filepath.Dir(sw.ConfigFile), 0755); err != nil {
+	return err
+    }
+    tmp := sw.ConfigFile + ".tmp"
+    if err := ioutil.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+	return err
+    }
+    return os.Rename(tmp, sw.ConfigFile)
+}
@@ -0,0 +1,184 @@
+// tools/sw / vlan_test.go
+//
+// MIT License Copyright(c) 2021 Hiroshi Shimamoto
+// vim:set sw=4 sts=4:
+//
+package main
+
+import (
+    "fmt"
+    "io/ioutil"
+    "path/filepath"
+    "reflect"
+    "sync"
+    "testing"
+
+    ctl "vm/sw"
+)
+
+func setPort(t *testing.T, sw *Switch, name string, settings ...string) {
+    if _, err := sw.SetPort(name, settings); err != nil {
+	t.Fatal(err)
+    }
+}
+
+func TestTag(t *testing.T) {
+    f := frame(macA, macB, "payload")
+    tagged := tag(10, f)
+    if len(tagged) != len(f) + 4 || tagged[12] != 0x81 || tagged[13] != 0x00 || tagged[15] != 10 {
+	t.Fatalf("tag: %x", tagged)
+    }
+    vid, untagged := untag(tagged)
+    if vid != 10 || !reflect.DeepEqual(untagged, f) {
+	t.Fatalf("untag: %d %x", vid, untagged)
+    }
+    if vid, same := untag(f); vid != 0 || !reflect.DeepEqual(same, f) {
+	t.Fatalf("untag plain: %d %x", vid, same)
+    }
+}
+
+func TestAccessVLAN(t *testing.T) {
+    sw := quiet(NewSwitch(), t)
+    setPort(t, sw, "a", "mode=access", "vlan=10")
+    setPort(t, sw, "b", "mode=access", "vlan=10")
+    setPort(t, sw, "c", "mode=access", "vlan=20")
+    setPort(t, sw, "trunk", "mode=trunk", "allowed=10,20", "native=none")
+    a, b, c, trunk := plug(t, sw, "a"), plug(t, sw, "b"), plug(t, sw, "c"), plug(t, sw, "trunk")
+    // a broadcast stays in vlan 10 and gets the tag on the trunk
+    f := frame(bcast, macA, "hello")
+    a.send(t, f)
+    b.expect(t, "b", f)
+    trunk.expect(t, "trunk", tag(10, f))
+    c.nothing(t, "c")
+    // a tagged frame from the trunk goes out untagged on its access port
+    f = frame(bcast, macC, "twenty")
+    trunk.send(t, tag(20, f))
+    c.expect(t, "c", f)
+    a.nothing(t, "a")
+    b.nothing(t, "b")
+    // untagged frames on a trunk without native vlan and
+    // tagged frames on an access port are dropped
+    trunk.send(t, f)
+    a.send(t, tag(10, frame(bcast, macA, "tagged")))
+    a.nothing(t, "a")
+    b.nothing(t, "b")
+    c.nothing(t, "c")
+    trunk.nothing(t, "trunk")
+    // vlan 30 is not allowed on the trunk
+    trunk.send(t, tag(30, frame(bcast, macB, "thirty")))
+    a.nothing(t, "a")
+    c.nothing(t, "c")
+}
+
+func TestVLANLearning(t *testing.T) {
+    sw := quiet(NewSwitch(), t)
+    setPort(t, sw, "a", "mode=access", "vlan=10")
+    setPort(t, sw, "b", "mode=access", "vlan=20")
+    a, b, trunk := plug(t, sw, "a"), plug(t, sw, "b"), plug(t, sw, "trunk")
+    // the same MAC is learned apart in each vlan
+    a.send(t, frame(bcast, macA, "ten"))
+    trunk.expect(t, "trunk", tag(10, frame(bcast, macA, "ten")))
+    b.send(t, frame(bcast, macA, "twenty"))
+    trunk.expect(t, "trunk", tag(20, frame(bcast, macA, "twenty")))
+    table := sw.Table()
+    if len(table) != 2 || table[0].VLAN != 10 || table[0].Port != "a" || table[1].VLAN != 20 || table[1].Port != "b" {
+	t.Fatalf("table: %v", table)
+    }
+    f := frame(macA, macC, "to twenty")
+    trunk.send(t, tag(20, f))
+    b.expect(t, "b", f)
+    a.nothing(t, "a")
+}
+
+func TestIsolated(t *testing.T) {
+    sw := quiet(NewSwitch(), t)
+    setPort(t, sw, "a", "isolated=on")
+    setPort(t, sw, "b", "isolated=on")
+    setPort(t, sw, "up", "uplink=on")
+    a, b, c, up := plug(t, sw, "a"), plug(t, sw, "b"), plug(t, sw, "c"), plug(t, sw, "up")
+    f := frame(bcast, macA, "from a")
+    a.send(t, f)
+    up.expect(t, "up", f)
+    b.nothing(t, "b")
+    c.nothing(t, "c")
+    // a known unicast to another isolated port is dropped too
+    learned(t, sw, macA, "a")
+    b.send(t, frame(macA, macB, "to a"))
+    up.nothing(t, "up")
+    a.nothing(t, "a")
+    f = frame(bcast, macC, "from c")
+    c.send(t, f)
+    up.expect(t, "up", f)
+    a.nothing(t, "a")
+    b.nothing(t, "b")
+    f = frame(bcast, macC, "from up")
+    up.send(t, f)
+    a.expect(t, "a", f)
+    b.expect(t, "b", f)
+    c.expect(t, "c", f)
+}
+
+func TestPortConfigFile(t *testing.T) {
+    file := filepath.Join(t.TempDir(), "sw", "test.json")
+    sw := quiet(NewSwitch(), t)
+    sw.ConfigFile = file
+    setPort(t, sw, "vm.vnic1", "mode=access", "vlan=10")
+    setPort(t, sw, "up", "allowed=10,20", "uplink=on")
+    if _, err := sw.SetPort("up", []string{ "vlan=5000" }); err == nil {
+	t.Fatal("vlan 5000 is accepted")
+    }
+    again := quiet(NewSwitch(), t)
+    again.ConfigFile = file
+    if err := again.LoadConfig(); err != nil {
+	t.Fatal(err)
+    }
+    want := map[string]ctl.PortConfig{
+	"vm.vnic1": { Mode: "access", VLAN: 10, Native: 1 },
+	"up": { Mode: "trunk", Allowed: []int{ 10, 20 }, Native: 1, Uplink: true },
+    }
+    if got := again.Configs(); !reflect.DeepEqual(got, want) {
+	t.Fatalf("got %v, want %v", got, want)
+    }
+    // no file is no settings
+    none := NewSwitch()
+    none.ConfigFile = filepath.Join(t.TempDir(), "none.json")
+    if err := none.LoadConfig(); err != nil || len(none.Configs()) != 0 {
+	t.Fatalf("none: %v %v", err, none.Configs())
+    }
+}
+
+func TestSetPortSave(t *testing.T) {
+    dir := t.TempDir()
+    sw := quiet(NewSwitch(), t)
+    sw.ConfigFile = filepath.Join(dir, "test.json")
+    // concurrent control connections each saving the whole config
+    var wg sync.WaitGroup
+    for i := 1; i <= 20; i++ {
+	wg.Add(1)
+	go func(i int) {
+	    defer wg.Done()
+	    if _, err := sw.SetPort(fmt.Sprintf("p%d", i), []string{ "mode=access", fmt.Sprintf("vlan=%d", i) }); err != nil {
+		t.Error(err)
+	    }
+	}(i)
+    }
+    wg.Wait()
+    again := NewSwitch()
+    again.ConfigFile = sw.ConfigFile
+    if err := again.LoadConfig(); err != nil {
+	t.Fatal(err)
+    }
+    if got := again.Configs(); len(got) != 20 || !reflect.DeepEqual(got, sw.Configs()) {
+	t.Fatalf("saved %v", got)
+    }
+    // a failed save changes nothing
+    file := filepath.Join(dir, "file")
+    ioutil.WriteFile(file, nil, 0644)
+    sw.ConfigFile = filepath.Join(file, "test.json")
+    if _, err := sw.SetPort("p1", []string{ "vlan=100" }); err == nil {
+	t.Fatal("saved under a file")
+    }
+    if c := sw.Configs()["p1"]; c.VLAN != 1 {
+	t.Errorf("p1 changed to %v", c)
+    }
+}
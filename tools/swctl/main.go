@@ -7,46 +7,131 @@ package main
 
 import (
     "fmt"
-    "net"
     "os"
+    "path/filepath"
+    "sort"
+    "strings"
     "time"
+
+    ctl "vm/sw"
+)
+
+// exit status
+const (
+    exitOK = 0
+    exitFailed = 1 // the switch refused
+    exitUsage = 2
+    exitControl = 3 // no switch to talk to
 )
 
-func instance(name string) {
-    fmt.Println(name)
+func usage() {
+    fmt.Println("swctl connect <switch> <addr> [port]")
+    fmt.Println("swctl disconnect <switch> <port>")
+    fmt.Println("swctl list-ports <switch>")
+    fmt.Println("swctl show-mac-table <switch>")
+    fmt.Println("swctl stats <switch>")
+    fmt.Println("swctl capture <switch> <port|all> <file> [filter]")
+    fmt.Println("swctl capture-stop <switch> <file>")
+    fmt.Println("swctl set-port <switch> <port> key=value...")
+    fmt.Println("  mode=access|trunk vlan=N allowed=all|N,N.. native=N|none isolated=on|off uplink=on|off")
+    fmt.Println("swctl show-config <switch>")
+    os.Exit(exitUsage)
 }
 
 func main() {
-    if len(os.Args) <= 3 {
-	os.Exit(1)
+    if len(os.Args) < 3 {
+	usage()
     }
     cmd := os.Args[1]
     name := os.Args[2]
-    param := os.Args[3]
-
-    sockpath := fmt.Sprintf("/tmp/vm-sw-%s.sock", name)
-    msg := ""
+    args := os.Args[3:]
 
-    if cmd == "connect" {
-	msg = "+"
-    } else if cmd == "disconnect" {
-	msg = "-"
-    } else {
+    req := &ctl.Request{ Command: cmd }
+    switch cmd {
+    case ctl.Connect:
+	if len(args) < 1 {
+	    usage()
+	}
+	req.Addr = args[0]
+	if len(args) > 1 {
+	    req.Port = args[1]
+	}
+    case ctl.Disconnect:
+	if len(args) < 1 {
+	    usage()
+	}
+	req.Port = args[0]
+    case ctl.Capture:
+	if len(args) < 2 {
+	    usage()
+	}
+	req.Port = args[0]
+	// the switch runs elsewhere
+	req.File, _ = filepath.Abs(args[1])
+	req.Filter = strings.Join(args[2:], " ")
+    case ctl.CaptureStop:
+	if len(args) < 1 {
+	    usage()
+	}
+	req.File, _ = filepath.Abs(args[0])
+    case ctl.SetPort:
+	if len(args) < 2 {
+	    usage()
+	}
+	req.Port = args[0]
+	req.Settings = args[1:]
+	// catch typos before bothering the switch
+	c := ctl.DefaultPortConfig()
+	for _, s := range req.Settings {
+	    if err := c.Set(s); err != nil {
+		fmt.Printf("set-port: %v\n", err)
+		os.Exit(exitUsage)
+	    }
+	}
+    case ctl.ListPorts, ctl.ShowMACTable, ctl.Stats, ctl.ShowConfig:
+    default:
 	fmt.Printf("unknown command: %s\n", cmd)
-	os.Exit(1)
+	usage()
     }
 
-    msg += param
-
-    // try to dial and send command
-    conn, err := net.Dial("unix", sockpath)
+    resp, err := ctl.Call(name, req, 10 * time.Second)
     if err != nil {
-	fmt.Printf("control error: %s\n", err)
-	os.Exit(1)
+	if resp != nil {
+	    fmt.Printf("%v\n", err)
+	    os.Exit(exitFailed)
+	}
+	fmt.Printf("%s: %v\n", cmd, err)
+	os.Exit(exitControl)
     }
-
-    conn.Write([]byte(msg))
-
-    // wait a bit
-    time.Sleep(time.Second)
+    switch cmd {
+    case ctl.ListPorts:
+	for _, p := range resp.Ports {
+	    fmt.Printf("%s %s %s\n", p.Name, p.State, p.Remote)
+	}
+    case ctl.ShowMACTable:
+	for _, e := range resp.Table {
+	    fmt.Printf("%4d %s %s %ds\n", e.VLAN, e.MAC, e.Port, e.Age)
+	}
+    case ctl.Stats:
+	st := resp.Stats
+	fmt.Printf("forwarded %d flooded %d filtered %d\n", st.Forwarded, st.Flooded, st.Filtered)
+	for _, p := range st.Ports {
+	    fmt.Printf("%s rx %d/%dB tx %d/%dB drops %d\n",
+		p.Name, p.RxFrames, p.RxBytes, p.TxFrames, p.TxBytes, p.Drops)
+	}
+    case ctl.CaptureStop:
+	fmt.Printf("%d frames in %s\n", resp.Frames, req.File)
+    case ctl.SetPort, ctl.ShowConfig:
+	names := []string{}
+	for name := range resp.Configs {
+	    names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+	    fmt.Printf("%s %s\n", name, resp.Configs[name])
+	}
+    default:
+	fmt.Println("ok")
+    }
+    os.Exit(exitOK)
 }